@@ -3,23 +3,198 @@ package backend
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/heilerich/dhcpd-coredns/config"
+	"go.uber.org/zap"
 	"inet.af/netaddr"
 )
 
 type Lease interface {
 	GetName() string
 	GetAddress() netaddr.IP
+	// GetEnds returns the end of the lease or the zero time if it never ends
+	GetEnds() time.Time
 }
 
 type Backend interface {
 	Put(context.Context, Lease) error
+	// Delete removes the records of a lease, it does nothing if there are
+	// none
+	Delete(context.Context, Lease) error
+	// List returns all records published by the backend
+	List(context.Context) ([]*Record, error)
+	// Get returns the records of a name or ErrNotFound
+	Get(ctx context.Context, name string) ([]*Record, error)
+	// Reconcile makes the records of the backend match the complete set of
+	// current leases and removes the records of all other leases. Records
+	// that cannot be written or removed are skipped, the first error is
+	// returned after the other records have been reconciled.
+	Reconcile(context.Context, []Lease) (*Diff, error)
 	Cleanup(context.Context) error
 	Close(context.Context) error
 }
 
+// Record is a record published by a backend.
+type Record struct {
+	Name    string
+	Address netaddr.IP
+	// Expires is when the record is removed unless it is refreshed, i.e.
+	// the time of its heartbeat
+	Expires time.Time
+}
+
+func (r *Record) String() string {
+	return fmt.Sprintf("%v (%v)", r.Name, r.Address)
+}
+
+// SortRecords orders records by name and address.
+func SortRecords(records []*Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Address.Less(records[j].Address)
+	})
+}
+
+// GetListed returns the records of a name listed by b, ignoring its case, or
+// ErrNotFound. It implements Get on top of List.
+func GetListed(ctx context.Context, b Backend, name string) ([]*Record, error) {
+	records, err := b.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []*Record{}
+	for _, record := range records {
+		if strings.EqualFold(record.Name, name) {
+			filtered = append(filtered, record)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, ErrNotFound
+	}
+	return filtered, nil
+}
+
+// Deadline returns the time after which the record of a lease is removed
+// unless it is refreshed. It is the end of the lease, but no later than
+// timeout after now, so that the records of leases that disappear from the
+// lease file expire as well.
+func Deadline(lease Lease, now time.Time, timeout time.Duration) time.Time {
+	deadline := now.UTC().Add(timeout)
+	if ends := lease.GetEnds(); !ends.IsZero() && ends.Before(deadline) {
+		return ends.UTC()
+	}
+	return deadline
+}
+
+// Matching returns the leases of the records for which fn reports true,
+// ordered by their key. lease returns the lease a record has been written
+// for.
+func Matching[R any](records map[string]R, lease func(R) Lease, fn func(key string, record R) bool) []Lease {
+	keys := []string{}
+	for key, record := range records {
+		if fn(key, record) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	leases := make([]Lease, len(keys))
+	for i, key := range keys {
+		leases[i] = lease(records[key])
+	}
+	return leases
+}
+
+// Change tells how writing the records of a lease has changed them.
+type Change int
+
+const (
+	ChangeNone Change = iota
+	ChangeAdded
+	ChangeUpdated
+)
+
+// Reconciler drives the Reconcile of a backend with its own operations.
+type Reconciler struct {
+	// Logger logs the records that cannot be written or deleted
+	Logger *zap.Logger
+	// Key returns the key of the records of a lease
+	Key func(Lease) string
+	Put func(context.Context, Lease) (Change, error)
+	// Stale returns the leases of the records of the backend whose key is
+	// not desired, ordered by key
+	Stale  func(desired map[string]struct{}) []Lease
+	Delete func(context.Context, Lease) error
+}
+
+// Reconcile implements Backend.Reconcile with the operations of r and logs
+// the records it skips.
+func (r Reconciler) Reconcile(ctx context.Context, leases []Lease) (*Diff, error) {
+	logger := r.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	diff := &Diff{}
+	var firstErr error
+	desired := make(map[string]struct{}, len(leases))
+	for _, lease := range leases {
+		desired[r.Key(lease)] = struct{}{}
+
+		change, err := r.Put(ctx, lease)
+		if err != nil {
+			logger.Warn("failed to write record", zap.String("name", lease.GetName()), zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		switch change {
+		case ChangeAdded:
+			diff.Added = append(diff.Added, lease)
+		case ChangeUpdated:
+			diff.Updated = append(diff.Updated, lease)
+		}
+	}
+
+	for _, lease := range r.Stale(desired) {
+		if err := r.Delete(ctx, lease); err != nil {
+			logger.Warn("failed to delete record", zap.String("name", lease.GetName()), zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		diff.Deleted = append(diff.Deleted, lease)
+	}
+	return diff, firstErr
+}
+
+// Diff lists the leases whose records a reconcile has changed.
+type Diff struct {
+	Added   []Lease
+	Updated []Lease
+	Deleted []Lease
+}
+
+// Empty reports whether the reconcile did not change anything.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Deleted) == 0
+}
+
+// Flusher is implemented by backends that defer some writes of Put until
+// Flush is called at the end of a sync.
+type Flusher interface {
+	Flush(context.Context) error
+}
+
 func LeaseID(lease Lease) string {
 	addr := lease.GetAddress()
 	if addr.Is6() {
@@ -28,6 +203,70 @@ func LeaseID(lease Lease) string {
 	return fmt.Sprintf("%x", addr.As4())
 }
 
+// BuildKey returns the key of the record of a lease below prefix. The labels
+// of the name are reversed into path elements followed by the LeaseID, e.g.
+// /skydns/test/run/host/0a000001 for host at 10.0.0.1 below
+// /skydns/test/run/.
+func BuildKey(lease Lease, prefix string) string {
+	key := strings.TrimSuffix(prefix, "/")
+	zones := strings.Split(lease.GetName(), ".")
+
+	for i := len(zones) - 1; i >= 0; i-- {
+		key = fmt.Sprintf("%v/%v", key, zones[i])
+	}
+
+	key = fmt.Sprintf("%v/%v", key, LeaseID(lease))
+
+	return key
+}
+
+// ZoneDomain returns the domain of the zone stored below dnsPrefix, e.g.
+// run.test for /skydns/test/run/ below the root /skydns/.
+func ZoneDomain(dnsPrefix, rootPrefix string) string {
+	path := strings.Trim(strings.TrimPrefix(dnsPrefix, rootPrefix), "/")
+	if path == "" {
+		return ""
+	}
+
+	elements := strings.Split(path, "/")
+	labels := make([]string, len(elements))
+	for i, element := range elements {
+		labels[len(elements)-1-i] = element
+	}
+	return strings.Join(labels, ".")
+}
+
+// RecordName returns the name of the record of a lease whose key is built
+// below dnsPrefix, relative to the zone of rootPrefix, e.g. host.run.test for
+// host below /skydns/test/run/ and the root /skydns/.
+func RecordName(lease Lease, dnsPrefix, rootPrefix string) string {
+	key := strings.TrimSuffix(BuildKey(lease, dnsPrefix), "/"+LeaseID(lease))
+	return ZoneDomain(key, rootPrefix)
+}
+
+// ReverseZone returns the in-addr.arpa or ip6.arpa zone of a network that is
+// cut at an octet or nibble, e.g. 10.in-addr.arpa. for 10.0.0.0/8.
+func ReverseZone(prefix netaddr.IPPrefix) string {
+	labels := []string{}
+	if prefix.IP().Is4() {
+		octets := prefix.IP().As4()
+		for _, octet := range octets[:prefix.Bits()/8] {
+			labels = append([]string{fmt.Sprint(octet)}, labels...)
+		}
+		return strings.Join(append(labels, "in-addr.arpa."), ".")
+	}
+
+	bytes := prefix.IP().As16()
+	for i := 0; i < int(prefix.Bits())/4; i++ {
+		nibble := bytes[i/2] >> 4
+		if i%2 == 1 {
+			nibble = bytes[i/2] & 0xf
+		}
+		labels = append([]string{fmt.Sprintf("%x", nibble)}, labels...)
+	}
+	return strings.Join(append(labels, "ip6.arpa."), ".")
+}
+
 type SyncFn func(ctx context.Context)
 
 func RunCleaner(ctx context.Context, backend Backend, syncFn SyncFn, cfg *config.Config) error {
@@ -48,3 +287,11 @@ func RunCleaner(ctx context.Context, backend Backend, syncFn SyncFn, cfg *config
 		}
 	}
 }
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrNotFound = Error("no record found")
+)
@@ -0,0 +1,198 @@
+// Package backendtest holds the conformance tests every backend.Backend has
+// to pass.
+package backendtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inet.af/netaddr"
+)
+
+// Factory returns an empty backend for a single test. The backend is closed
+// by the test.
+type Factory func(t *testing.T) backend.Backend
+
+// Lease is a lease for backend tests.
+type Lease struct {
+	Name    string
+	Address netaddr.IP
+	Ends    time.Time
+}
+
+func (l *Lease) GetName() string        { return l.Name }
+func (l *Lease) GetAddress() netaddr.IP { return l.Address }
+func (l *Lease) GetEnds() time.Time     { return l.Ends }
+
+// NewLease returns a lease that never ends.
+func NewLease(name, address string) *Lease {
+	return &Lease{Name: name, Address: netaddr.MustParseIP(address)}
+}
+
+// Run runs the conformance tests against the backends returned by factory.
+func Run(t *testing.T, factory Factory) {
+	tests := map[string]func(t *testing.T, b backend.Backend){
+		"PutAndList":         testPutAndList,
+		"PutTwice":           testPutTwice,
+		"Get":                testGet,
+		"Delete":             testDelete,
+		"Reconcile":          testReconcile,
+		"CleanupExpired":     testCleanupExpired,
+		"RecordExpiry":       testRecordExpiry,
+		"DeleteMissingLease": testDeleteMissing,
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			b := factory(t)
+			defer b.Close(context.Background())
+			test(t, b)
+		})
+	}
+}
+
+// LeaseTimeout is the lease timeout of the sources returned by Source.
+const LeaseTimeout = time.Minute
+
+// Source returns a lease source with the records below zone for tests of
+// backends that are built per source.
+func Source(name, zone string) *config.LeaseConfig {
+	return &config.LeaseConfig{Name: name, Zone: zone, Timeout: LeaseTimeout}
+}
+
+// Names returns the records in the form name (address).
+func Names(records []*backend.Record) []string {
+	result := []string{}
+	for _, record := range records {
+		result = append(result, record.String())
+	}
+	return result
+}
+
+// List returns the records of a backend in the form name (address).
+func List(t *testing.T, b backend.Backend) []string {
+	records, err := b.List(context.Background())
+	require.NoError(t, err)
+	return Names(records)
+}
+
+func testPutAndList(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+
+	assert.Empty(t, List(t, b), "new backend is empty")
+
+	require.NoError(t, b.Put(ctx, NewLease("host1", "10.0.0.1")))
+	require.NoError(t, b.Put(ctx, NewLease("host2", "2001:db8::2")))
+	require.NoError(t, b.Put(ctx, NewLease("host1", "10.0.0.3")))
+	flush(t, b)
+
+	assert.Equal(t, []string{"host1 (10.0.0.1)", "host1 (10.0.0.3)", "host2 (2001:db8::2)"}, List(t, b),
+		"records are listed by name and address")
+}
+
+func testPutTwice(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+
+	lease := NewLease("host", "10.0.0.1")
+	require.NoError(t, b.Put(ctx, lease))
+	require.NoError(t, b.Put(ctx, lease))
+	flush(t, b)
+
+	assert.Equal(t, []string{"host (10.0.0.1)"}, List(t, b), "a lease has a single record")
+}
+
+func testGet(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+
+	require.NoError(t, b.Put(ctx, NewLease("host", "10.0.0.1")))
+	require.NoError(t, b.Put(ctx, NewLease("host", "10.0.0.2")))
+	require.NoError(t, b.Put(ctx, NewLease("other", "10.0.0.3")))
+	flush(t, b)
+
+	records, err := b.Get(ctx, "host")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host (10.0.0.1)", "host (10.0.0.2)"}, Names(records))
+
+	_, err = b.Get(ctx, "missing")
+	assert.ErrorIs(t, err, backend.ErrNotFound)
+}
+
+func testDelete(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+
+	lease := NewLease("host", "10.0.0.1")
+	require.NoError(t, b.Put(ctx, lease))
+	require.NoError(t, b.Put(ctx, NewLease("host", "10.0.0.2")))
+	flush(t, b)
+
+	require.NoError(t, b.Delete(ctx, lease))
+	assert.Equal(t, []string{"host (10.0.0.2)"}, List(t, b))
+}
+
+func testDeleteMissing(t *testing.T, b backend.Backend) {
+	assert.NoError(t, b.Delete(context.Background(), NewLease("host", "10.0.0.1")))
+	assert.Empty(t, List(t, b))
+}
+
+func testReconcile(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+
+	kept := NewLease("kept", "10.0.0.1")
+	released := NewLease("released", "10.0.0.2")
+	added := NewLease("added", "10.0.0.3")
+
+	require.NoError(t, b.Put(ctx, kept))
+	require.NoError(t, b.Put(ctx, released))
+	flush(t, b)
+
+	diff, err := b.Reconcile(ctx, []backend.Lease{kept, added})
+	require.NoError(t, err)
+	assert.Equal(t, []backend.Lease{added}, diff.Added)
+	assert.Empty(t, diff.Updated)
+	if assert.Len(t, diff.Deleted, 1) {
+		assert.Equal(t, "released", diff.Deleted[0].GetName())
+	}
+	assert.Equal(t, []string{"added (10.0.0.3)", "kept (10.0.0.1)"}, List(t, b))
+
+	diff, err = b.Reconcile(ctx, []backend.Lease{kept, added})
+	require.NoError(t, err)
+	assert.True(t, diff.Empty(), "reconciling again changes nothing")
+}
+
+func testCleanupExpired(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+
+	expired := &Lease{Name: "expired", Address: netaddr.MustParseIP("10.0.0.1"), Ends: time.Now().Add(-time.Minute)}
+	require.NoError(t, b.Put(ctx, expired))
+	require.NoError(t, b.Put(ctx, NewLease("current", "10.0.0.2")))
+	flush(t, b)
+
+	require.NoError(t, b.Cleanup(ctx))
+	assert.Equal(t, []string{"current (10.0.0.2)"}, List(t, b), "expired record is removed")
+}
+
+func testRecordExpiry(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+
+	// the lease ends before the lease timeout of the backend caps its deadline
+	ends := time.Now().Add(30 * time.Second).Truncate(time.Second).UTC()
+	require.NoError(t, b.Put(ctx, &Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1"), Ends: ends}))
+	flush(t, b)
+
+	records, err := b.Get(ctx, "host")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.True(t, ends.Equal(records[0].Expires), "record expires with its lease, got %v", records[0].Expires)
+}
+
+func flush(t *testing.T, b backend.Backend) {
+	if flusher, ok := b.(backend.Flusher); ok {
+		require.NoError(t, flusher.Flush(context.Background()))
+	}
+}
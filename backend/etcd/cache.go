@@ -0,0 +1,211 @@
+package etcd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// cache mirrors the keys below some prefixes, so that the backend can skip
+// writes that would not change anything. It is seeded by a Get of every
+// prefix and follows later changes with a Watch.
+type cache struct {
+	kv       clientv3.KV
+	watcher  clientv3.Watcher
+	prefixes []string
+	logger   *zap.Logger
+
+	mu sync.RWMutex
+	// kvs is nil until all prefixes have been read
+	kvs     map[string]*mvccpb.KeyValue
+	started bool
+	cancel  context.CancelFunc
+	// restart makes run start over with the current prefixes
+	restart context.CancelFunc
+	// done is closed when run returns
+	done chan struct{}
+}
+
+const cacheRetryInterval = 5 * time.Second
+
+func newCache(kv clientv3.KV, watcher clientv3.Watcher, prefixes []string, logger *zap.Logger) *cache {
+	return &cache{
+		kv:       kv,
+		watcher:  watcher,
+		prefixes: prefixes,
+		logger:   logger,
+	}
+}
+
+// add follows the keys below prefix as well unless a followed prefix covers
+// them already. A running cache starts over to read them.
+func (c *cache) add(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefixes := []string{}
+	for _, followed := range c.prefixes {
+		if strings.HasPrefix(prefix, followed) {
+			return
+		}
+		if !strings.HasPrefix(followed, prefix) {
+			prefixes = append(prefixes, followed)
+		}
+	}
+	c.prefixes = append(prefixes, prefix)
+	c.logger.Debug("following prefix", zap.String("prefix", prefix))
+
+	if c.restart != nil {
+		c.restart()
+	}
+}
+
+// get returns the cached key. It reports a missing key while the cache is
+// not in sync yet, so that callers fall back to writing.
+func (c *cache) get(key string) (*mvccpb.KeyValue, bool) {
+	c.start()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	kv, ok := c.kvs[key]
+	return kv, ok
+}
+
+// start starts following the prefixes unless this has been done before.
+func (c *cache) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.started || c.watcher == nil {
+		return
+	}
+	c.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		c.run(ctx)
+	}()
+}
+
+// close stops following the prefixes and waits until it has stopped.
+func (c *cache) close() {
+	c.mu.Lock()
+	cancel, done := c.cancel, c.done
+	c.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// run keeps the cache in sync until ctx is done and starts over whenever the
+// watch fails, e.g. after a compaction, or prefixes have been added.
+func (c *cache) run(ctx context.Context) {
+	for {
+		followCtx, restart := context.WithCancel(ctx)
+		c.mu.Lock()
+		c.restart = restart
+		prefixes := append([]string{}, c.prefixes...)
+		c.mu.Unlock()
+
+		err := c.follow(followCtx, prefixes)
+		restart()
+		c.invalidate()
+		if ctx.Err() != nil {
+			return
+		}
+		if followCtx.Err() != nil {
+			continue
+		}
+
+		c.logger.Warn("lost sync with etcd, reading keys again", zap.Error(err))
+		select {
+		case <-time.After(cacheRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *cache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kvs = nil
+}
+
+func (c *cache) follow(ctx context.Context, prefixes []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	kvs := make(map[string]*mvccpb.KeyValue)
+	events := make(chan clientv3.WatchResponse)
+	for _, prefix := range prefixes {
+		resp, err := c.kv.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			kvs[string(kv.Key)] = kv
+		}
+
+		watch := c.watcher.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		go func() {
+			for resp := range watch {
+				select {
+				case events <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+			// the channel closes if the watch fails or ctx is done
+			select {
+			case events <- clientv3.WatchResponse{Canceled: true}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	c.mu.Lock()
+	c.kvs = kvs
+	c.mu.Unlock()
+	c.logger.Debug("cached keys", zap.Int("count", len(kvs)), zap.Strings("prefixes", prefixes))
+
+	for {
+		select {
+		case resp := <-events:
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			c.apply(resp.Events)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *cache) apply(events []*clientv3.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.kvs == nil {
+		return
+	}
+	for _, event := range events {
+		switch event.Type {
+		case clientv3.EventTypePut:
+			c.kvs[string(event.Kv.Key)] = event.Kv
+		case clientv3.EventTypeDelete:
+			delete(c.kvs, string(event.Kv.Key))
+		}
+	}
+}
@@ -4,93 +4,312 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/heilerich/dhcpd-coredns/backend"
 	"github.com/heilerich/dhcpd-coredns/config"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
+	"inet.af/netaddr"
 )
 
 type etcdBackend struct {
-	client                  clientv3.Client
+	client                  *clientv3.Client
+	kv                      clientv3.KV
+	lessor                  clientv3.Lease
+	watcher                 clientv3.Watcher
 	dnsPrefix, configPrefix string
 	leaseTimeout            time.Duration
-	logger                  *zap.Logger
+	// cleanupInterval is the time between syncs without changes of the
+	// lease file
+	cleanupInterval time.Duration
+	logger          *zap.Logger
+
+	// reversePrefix is the root prefix of the PTR records or empty if they
+	// are disabled
+	reversePrefix string
+	reverseZones  []netaddr.IPPrefix
+	// domain is the domain of the forward records that PTR records point to
+	domain string
+	// owner is the name of the lease source, written to its records so that
+	// records without heartbeat can be told apart from those of other sources
+	owner string
+
+	// expiry selects how expired records are removed
+	expiry string
+	mu     sync.Mutex
+	// live is the grant kept alive by Flush, ending holds the grants of
+	// leases that end soon by the Unix time of their expiry
+	live   *grant
+	ending map[int64]*grant
+	// attached holds the grants and deadlines of the records by their key
+	attached map[string]*attachment
+	// heartbeats holds the heartbeats of unchanged records until Flush
+	// writes them
+	heartbeats map[string]*heartbeat
+
+	// cache is shared by the backend and the backends of its sources
+	cache *cache
+	// source is set for backends of ForSource, which leave the connection
+	// and the cache to be closed by the backend they have been built from
+	source bool
 }
 
 var _ backend.Backend = &etcdBackend{}
 
+// NewEtcdBackend connects to etcd. The returned backend writes to the
+// configured key prefixes, use ForSource to get the backend of a lease
+// source.
 func NewEtcdBackend(cfg *config.Config, logger *zap.Logger) (*etcdBackend, error) {
 	cfg.Etcd.Logger = logger
+	expiry := cfg.Expiry
+	switch expiry {
+	case ExpiryHeartbeat, ExpiryLease:
+	case "":
+		expiry = ExpiryHeartbeat
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownExpiry, expiry)
+	}
+
+	reverseZones := make([]netaddr.IPPrefix, len(cfg.Reverse.Zones))
+	for i, zone := range cfg.Reverse.Zones {
+		prefix, err := netaddr.ParseIPPrefix(zone)
+		if err != nil {
+			return nil, err
+		}
+		reverseZones[i] = prefix
+	}
+
 	client, err := clientv3.New(cfg.Etcd)
 	if err != nil {
 		return nil, err
 	}
-	return &etcdBackend{
-		client:       *client,
-		dnsPrefix:    cfg.KeyPrefix.Zone,
-		configPrefix: cfg.KeyPrefix.Heartbeat,
-		leaseTimeout: cfg.Lease.Timeout,
-		logger:       logger,
-	}, nil
+	e := &etcdBackend{
+		client:          client,
+		kv:              client,
+		lessor:          client,
+		watcher:         client,
+		dnsPrefix:       cfg.KeyPrefix.Zone,
+		configPrefix:    cfg.KeyPrefix.Heartbeat,
+		cleanupInterval: cfg.CleanupInterval,
+		logger:          logger,
+		reversePrefix:   cfg.Reverse.Prefix,
+		reverseZones:    reverseZones,
+		domain:          backend.ZoneDomain(cfg.KeyPrefix.Zone, cfg.Reverse.Prefix),
+		expiry:          expiry,
+	}
+	e.init(nil)
+	return e, nil
 }
 
-func (e *etcdBackend) buildKey(lease backend.Lease, prefix string) string {
-	key := strings.TrimSuffix(prefix, "/")
-	zones := strings.Split(lease.GetName(), ".")
+// ForSource returns a backend sharing the connection of e that writes the
+// records of a lease source to its zone, marked with the name of the source.
+func (e *etcdBackend) ForSource(leaseCfg *config.LeaseConfig) *etcdBackend {
+	configPrefix := e.configPrefix
+	if leaseCfg.Name != "" {
+		configPrefix = fmt.Sprintf("%v/%v/", strings.TrimSuffix(configPrefix, "/"), leaseCfg.Name)
+	}
 
-	for i := len(zones) - 1; i >= 0; i-- {
-		key = fmt.Sprintf("%v/%v", key, zones[i])
+	dnsPrefix := leaseCfg.Zone
+	source := &etcdBackend{
+		client:          e.client,
+		kv:              e.kv,
+		lessor:          e.lessor,
+		watcher:         e.watcher,
+		dnsPrefix:       dnsPrefix,
+		configPrefix:    configPrefix,
+		leaseTimeout:    leaseCfg.Timeout,
+		cleanupInterval: e.cleanupInterval,
+		logger:          e.logger.With(zap.String("source", leaseCfg.Name)),
+		reversePrefix:   e.reversePrefix,
+		reverseZones:    e.reverseZones,
+		domain:          backend.ZoneDomain(dnsPrefix, e.reversePrefix),
+		owner:           leaseCfg.Name,
+		expiry:          e.expiry,
+		source:          true,
 	}
+	source.init(e.cache)
+	return source
+}
+
+// init sets up the state of a backend whose settings are filled in. The
+// backend uses the shared cache or, if it is nil, a cache of its own.
+func (e *etcdBackend) init(shared *cache) {
+	e.ending = make(map[int64]*grant)
+	e.attached = make(map[string]*attachment)
+	e.heartbeats = make(map[string]*heartbeat)
 
-	key = fmt.Sprintf("%v/%v", key, backend.LeaseID(lease))
+	prefixes := []string{e.dnsPrefix}
+	if e.expiry == ExpiryHeartbeat {
+		prefixes = append(prefixes, e.configPrefix)
+	}
+	if e.reversePrefix != "" {
+		prefixes = append(prefixes, strings.TrimSuffix(e.reversePrefix, "/")+"/arpa/")
+	}
 
-	return key
+	if shared == nil {
+		e.cache = newCache(e.kv, e.watcher, prefixes, e.logger)
+		return
+	}
+	for _, prefix := range prefixes {
+		shared.add(prefix)
+	}
+	e.cache = shared
 }
 
 func (e *etcdBackend) buildEntry(lease backend.Lease) *hostEntry {
 	return &hostEntry{
-		Host:  lease.GetAddress().String(),
-		Group: lease.GetName(),
-		TTL:   60,
+		Host:   lease.GetAddress().String(),
+		Group:  lease.GetName(),
+		TTL:    60,
+		Source: e.owner,
 	}
 }
 
 type hostEntry struct {
-	Host  string `json:"host"`
-	Group string `json:"group"`
-	TTL   int    `json:"ttl"`
+	Host   string `json:"host"`
+	Group  string `json:"group,omitempty"`
+	TTL    int    `json:"ttl"`
+	Source string `json:"source,omitempty"`
 }
 
+// Put writes the record of a lease together with its PTR record and
+// heartbeat in a single transaction. It does not overwrite a record with
+// different content unless its heartbeat or, in lease mode, its etcd lease
+// shows that the backend wrote it.
+// If the records are unchanged only the heartbeat is refreshed by the next
+// Flush.
 func (e *etcdBackend) Put(ctx context.Context, lease backend.Lease) error {
-	key := e.buildKey(lease, e.dnsPrefix)
+	_, err := e.put(ctx, lease)
+	return err
+}
+
+func (e *etcdBackend) put(ctx context.Context, lease backend.Lease) (backend.Change, error) {
+	key := backend.BuildKey(lease, e.dnsPrefix)
 
-	json, err := json.Marshal(e.buildEntry(lease))
+	value, err := json.Marshal(e.buildEntry(lease))
 	if err != nil {
-		return err
+		return backend.ChangeNone, err
 	}
 
-	_, err = e.client.Put(ctx, key, string(json))
-	if err != nil {
-		return err
+	var id clientv3.LeaseID
+	opts := []clientv3.OpOption{}
+	if e.expiry == ExpiryLease {
+		if id, err = e.grant(ctx, key, lease); err != nil {
+			return backend.ChangeNone, err
+		}
+		opts = append(opts, clientv3.WithLease(id))
+	}
+
+	ops := []clientv3.Op{clientv3.OpPut(key, string(value), opts...)}
+	unchanged := e.cached(key, string(value), id)
+
+	if reverseKey, ok := e.reverseKey(lease); ok {
+		value, err := json.Marshal(e.buildReverseEntry(lease))
+		if err != nil {
+			return backend.ChangeNone, err
+		}
+		ops = append(ops, clientv3.OpPut(reverseKey, string(value), opts...))
+		unchanged = unchanged && e.cached(reverseKey, string(value), id)
+	}
+
+	// a record with the same content is ours as well, e.g. after switching
+	// the expiry, records with other content are ours if they have a
+	// heartbeat or, in lease mode, are attached to an etcd lease
+	var otherwise []clientv3.Op
+	configKey := backend.BuildKey(lease, e.configPrefix)
+	if e.expiry == ExpiryHeartbeat {
+		deadline := backend.Deadline(lease, time.Now(), e.leaseTimeout)
+		if unchanged && e.refresh(configKey, deadline) {
+			return backend.ChangeNone, nil
+		}
+
+		ops = append(ops, clientv3.OpPut(configKey, heartbeatValue(deadline)))
+		otherwise = append(otherwise, clientv3.OpTxn(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(configKey), ">", 0)}, ops, nil))
+	} else {
+		if unchanged {
+			return backend.ChangeNone, nil
+		}
+
+		// records written before the expiry was switched to etcd leases
+		// lose their heartbeat
+		heartbeatOps := append(append([]clientv3.Op{}, ops...), clientv3.OpDelete(configKey))
+		otherwise = append(otherwise, clientv3.OpTxn(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.LeaseValue(key), "!=", 0)}, ops,
+			[]clientv3.Op{clientv3.OpTxn(
+				[]clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(configKey), ">", 0)}, heartbeatOps, nil)}))
 	}
 
-	configKey := e.buildKey(lease, e.configPrefix)
-	_, err = e.client.Put(ctx, configKey, fmt.Sprint(time.Now().UTC().Unix()))
+	resp, err := e.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(ops...).
+		Else(clientv3.OpTxn(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.Value(key), "=", string(value))}, ops, otherwise)).
+		Commit()
 	if err != nil {
-		return err
+		return backend.ChangeNone, err
 	}
 
-	return nil
+	// the branches of the transaction are the missing record, the record
+	// with the same content and the records that are ours otherwise
+	switch succeeded((*etcdserverpb.TxnResponse)(resp)) {
+	case 0:
+		return backend.ChangeAdded, nil
+	case 1:
+		return backend.ChangeNone, nil
+	case 2, 3:
+		return backend.ChangeUpdated, nil
+	}
+	return backend.ChangeNone, fmt.Errorf("%w: %v", ErrForeignRecord, key)
+}
+
+// cached reports whether the key is known to have the value and, if id is
+// not zero, to be attached to the etcd lease id.
+func (e *etcdBackend) cached(key, value string, id clientv3.LeaseID) bool {
+	kv, ok := e.cache.get(key)
+	if !ok || string(kv.Value) != value {
+		return false
+	}
+	return id == 0 || kv.Lease == int64(id)
+}
+
+// succeeded returns the nesting depth of the transaction that took the then
+// branch, where transactions are nested in the else branch of their parent.
+// It returns -1 if all transactions failed.
+func succeeded(resp *etcdserverpb.TxnResponse) int {
+	for depth := 0; resp != nil; depth++ {
+		if resp.Succeeded {
+			return depth
+		}
+		if len(resp.Responses) != 1 {
+			return -1
+		}
+		resp = resp.Responses[0].GetResponseTxn()
+	}
+	return -1
 }
 
 func (e *etcdBackend) Cleanup(ctx context.Context) error {
 	logger := e.logger.WithOptions(zap.Fields(zap.String("op", "etcd.Cleanup")))
 
-	resp, err := e.client.Get(
+	if e.expiry == ExpiryLease {
+		if err := e.removeExpired(ctx); err != nil {
+			return err
+		}
+		return e.revokeExpiredGrants(ctx)
+	}
+
+	// expiry is decided by the heartbeats, they have to be up to date
+	if err := e.Flush(ctx); err != nil {
+		return err
+	}
+
+	resp, err := e.kv.Get(
 		ctx, e.configPrefix,
 		clientv3.WithPrefix(),
 		clientv3.WithSort(clientv3.SortByValue, clientv3.SortAscend),
@@ -102,7 +321,7 @@ func (e *etcdBackend) Cleanup(ctx context.Context) error {
 	logger.Debug("received keys", zap.Int("count", int(resp.Count)))
 
 	for _, kv := range resp.Kvs {
-		if ok := e.handleKey(ctx, string(kv.Key), string(kv.Value)); !ok {
+		if ok := e.handleKey(ctx, kv); !ok {
 			break
 		}
 	}
@@ -110,51 +329,107 @@ func (e *etcdBackend) Cleanup(ctx context.Context) error {
 	return nil
 }
 
-func (e *etcdBackend) handleKey(ctx context.Context, key string, timeString string) bool {
+func (e *etcdBackend) handleKey(ctx context.Context, kv *mvccpb.KeyValue) bool {
+	key := string(kv.Key)
 	logger := e.logger.WithOptions(zap.Fields(zap.String("op", "etcd.remove"), zap.String("key", key)))
 
-	timeInt, err := strconv.ParseInt(timeString, 10, 64)
+	deadline, legacy, err := e.parseHeartbeat(string(kv.Value))
 	if err != nil {
-		logger.Warn("deleting key with invalid heartbeat timestamp", zap.String("key", key), zap.String("value", timeString), zap.Error(err))
-		if err := e.remove(ctx, key); err != nil {
+		logger.Warn("deleting key with invalid heartbeat timestamp", zap.String("key", key), zap.String("value", string(kv.Value)), zap.Error(err))
+		if err := e.remove(ctx, kv); err != nil {
 			logger.Warn("failed to delete key", zap.String("key", key), zap.Error(err))
 		}
 		return true
 	}
 
-	created := time.Unix(timeInt, 0)
-	if time.Now().UTC().Sub(created) > e.leaseTimeout {
+	if time.Now().UTC().After(deadline) {
 		logger.Info("remove expired lease", zap.String("key", key))
-		if err := e.remove(ctx, key); err != nil {
-			logger.Warn("failed to delete key", zap.String("key", key), zap.Error(err))
-		}
-
-		key = strings.Replace(key, e.configPrefix, e.dnsPrefix, 1)
-		if err := e.remove(ctx, key); err != nil {
+		if err := e.remove(ctx, kv); err != nil {
 			logger.Warn("failed to delete key", zap.String("key", key), zap.Error(err))
 		}
 		return true
 	}
 
-	//Reached list end
-	return false
+	// Reached list end, unless the heartbeat is a legacy one, which sort
+	// before the deadlines
+	return legacy
 }
 
-func (e *etcdBackend) remove(ctx context.Context, key string) error {
+// remove deletes a heartbeat together with its record and PTR record in a
+// single transaction, unless the heartbeat has been refreshed since it was
+// read.
+func (e *etcdBackend) remove(ctx context.Context, heartbeat *mvccpb.KeyValue) error {
+	configKey := string(heartbeat.Key)
+	key := strings.Replace(configKey, e.configPrefix, e.dnsPrefix, 1)
 	logger := e.logger.WithOptions(zap.Fields(zap.String("op", "etcd.remove"), zap.String("key", key)))
 
-	resp, err := e.client.Delete(ctx, key)
+	ops := []clientv3.Op{clientv3.OpDelete(key), clientv3.OpDelete(configKey)}
+	// the PTR record is missing if it has been written before PTR records
+	// were enabled
+	if reverseKey, ok := e.reverseKeyOf(configKey, e.configPrefix); ok {
+		ops = append(ops, clientv3.OpDelete(reverseKey))
+	}
+
+	resp, err := e.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(configKey), "=", heartbeat.ModRevision)).
+		Then(ops...).
+		Commit()
 	if err != nil {
 		return err
 	}
 
-	if resp.Deleted != 1 {
-		logger.Warn("deletion removed wrong number of keys", zap.Int("expected", 1), zap.Int("actual", int(resp.Deleted)))
+	if !resp.Succeeded {
+		logger.Debug("heartbeat has been refreshed, keeping record")
+		return nil
+	}
+
+	if deleted := resp.Responses[0].GetResponseDeleteRange().Deleted; deleted != 1 {
+		logger.Warn("deletion removed wrong number of keys", zap.Int("expected", 1), zap.Int("actual", int(deleted)))
 	}
 
 	return nil
 }
 
+// reverseKeyOf returns the key of the PTR record of the lease with the
+// record or heartbeat key below prefix.
+func (e *etcdBackend) reverseKeyOf(key, prefix string) (string, bool) {
+	if e.reversePrefix == "" {
+		return "", false
+	}
+
+	lease, err := leaseFromKey(key, prefix)
+	if err != nil {
+		e.logger.Warn("cannot find reverse record of key", zap.String("key", key), zap.Error(err))
+		return "", false
+	}
+	return e.reverseKey(lease)
+}
+
+// Close writes the queued heartbeats. The backend a source backend has been
+// built from closes the shared cache and connection, so it has to be closed
+// after its source backends.
 func (e *etcdBackend) Close(ctx context.Context) error {
+	if err := e.Flush(ctx); err != nil {
+		return err
+	}
+	if e.source {
+		return nil
+	}
+
+	e.cache.close()
+	if e.client == nil {
+		// the backend has been built around another KV
+		return nil
+	}
 	return e.client.Close()
 }
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrInvalidKey    = Error("key was not built from a lease")
+	ErrUnknownExpiry = Error("unknown record expiry")
+	ErrForeignRecord = Error("record exists with different content")
+)
@@ -0,0 +1,478 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/backend/backendtest"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap/zaptest"
+	"inet.af/netaddr"
+)
+
+func newTestBackend(t *testing.T, kv *memKV) *etcdBackend {
+	e := &etcdBackend{
+		kv:            kv,
+		dnsPrefix:     "/skydns/test/run/",
+		configPrefix:  "/dhcpd/run/",
+		leaseTimeout:  time.Minute,
+		logger:        zaptest.NewLogger(t),
+		reversePrefix: "/skydns/",
+		domain:        "run.test",
+		expiry:        ExpiryHeartbeat,
+	}
+	e.init(nil)
+	return e
+}
+
+var (
+	testLease       = &parser.Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1")}
+	testRecordKeys  = []string{"/dhcpd/run/host/0a000001", "/skydns/arpa/in-addr/10/0/0/1/host.run.test", "/skydns/test/run/host/0a000001"}
+	testRecordValue = `{"host":"10.0.0.1","group":"host","ttl":60}`
+)
+
+func TestPutIsAtomic(t *testing.T) {
+	kv := newMemKV()
+	kv.failAt = 1
+	e := newTestBackend(t, kv)
+
+	err := e.Put(context.Background(), testLease)
+	assert.ErrorIs(t, err, errInjected)
+	assert.Empty(t, kv.keys(), "nothing is written if the transaction fails")
+
+	_, then, _ := kv.lastTxn.Txn()
+	keys := []string{}
+	for _, op := range then {
+		if op.IsPut() {
+			keys = append(keys, string(op.KeyBytes()))
+		}
+	}
+	sort.Strings(keys)
+	assert.Equal(t, testRecordKeys, keys, "record, PTR record and heartbeat are written by the same transaction")
+
+	assert.NoError(t, e.Put(context.Background(), testLease))
+	assert.Equal(t, testRecordKeys, kv.keys())
+}
+
+func TestPutGuardsForeignRecords(t *testing.T) {
+	kv := newMemKV()
+	e := newTestBackend(t, kv)
+	ctx := context.Background()
+
+	_, err := kv.Put(ctx, testRecordKeys[2], `{"host":"10.0.0.1","ttl":3600}`)
+	assert.NoError(t, err)
+
+	err = e.Put(ctx, testLease)
+	assert.ErrorIs(t, err, ErrForeignRecord)
+	assert.Equal(t, testRecordKeys[2:], kv.keys(), "foreign record is kept")
+
+	// a record with the same content or a heartbeat belongs to the backend
+	_, err = kv.Put(ctx, testRecordKeys[2], testRecordValue)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Put(ctx, testLease))
+
+	_, err = kv.Put(ctx, testRecordKeys[2], `{"host":"10.0.0.1","ttl":3600}`)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Put(ctx, testLease))
+	assert.Equal(t, testRecordKeys, kv.keys())
+}
+
+func TestPutTakesOverChangedRecordsInLeaseMode(t *testing.T) {
+	kv := newMemKV()
+	e := newTestLeaseBackend(t, kv)
+	ctx := context.Background()
+	changed := `{"host":"10.0.0.1","ttl":3600}`
+
+	_, err := kv.Put(ctx, testRecordKeys[2], changed)
+	assert.NoError(t, err)
+	_, err = e.put(ctx, testLease)
+	assert.ErrorIs(t, err, ErrForeignRecord, "record without etcd lease or heartbeat is foreign")
+
+	// e.g. written by a source that has been renamed
+	grant, err := kv.Grant(ctx, 60)
+	assert.NoError(t, err)
+	_, err = kv.Put(ctx, testRecordKeys[2], changed, clientv3.WithLease(grant.ID))
+	assert.NoError(t, err)
+	result, err := e.put(ctx, testLease)
+	assert.NoError(t, err)
+	assert.Equal(t, backend.ChangeUpdated, result, "record attached to an etcd lease is taken over")
+	assert.NotEqual(t, int64(grant.ID), kv.kvs[testRecordKeys[2]].Lease)
+
+	// written before the expiry was switched to etcd leases
+	_, err = kv.Put(ctx, testRecordKeys[2], changed)
+	assert.NoError(t, err)
+	_, err = kv.Put(ctx, testRecordKeys[0], heartbeatValue(time.Now()))
+	assert.NoError(t, err)
+	result, err = e.put(ctx, testLease)
+	assert.NoError(t, err)
+	assert.Equal(t, backend.ChangeUpdated, result, "record with a heartbeat is taken over")
+	assert.Equal(t, testRecordKeys[1:], kv.keys(), "heartbeat is removed")
+	assert.Equal(t, testRecordValue, string(kv.kvs[testRecordKeys[2]].Value))
+}
+
+func TestCleanupIsAtomic(t *testing.T) {
+	expired := &parser.Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1"), Ends: time.Now().Add(-time.Minute)}
+
+	for failAt := 2; failAt <= 3; failAt++ {
+		kv := newMemKV()
+		e := newTestBackend(t, kv)
+		assert.NoError(t, e.Put(context.Background(), expired))
+
+		// the failed deletion is logged, a failed get is returned
+		kv.failAt = failAt
+		_ = e.Cleanup(context.Background())
+
+		assert.Equal(t, testRecordKeys, kv.keys(), "no key is removed if request %v fails", failAt)
+	}
+}
+
+func TestCleanupKeepsRefreshedRecords(t *testing.T) {
+	kv := newMemKV()
+	e := newTestBackend(t, kv)
+	ctx := context.Background()
+
+	expired := &parser.Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1"), Ends: time.Now().Add(-time.Minute)}
+	assert.NoError(t, e.Put(ctx, expired))
+
+	// the lease is renewed between reading and removing the heartbeat
+	kv.beforeTxn = func(kv *memKV) {
+		kv.beforeTxn = nil
+		_, err := kv.Put(ctx, testRecordKeys[0], heartbeatValue(time.Now().Add(time.Hour)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, e.Cleanup(ctx))
+	assert.Equal(t, testRecordKeys, kv.keys(), "refreshed record is kept")
+
+	assert.NoError(t, e.Put(ctx, expired))
+	assert.NoError(t, e.Cleanup(ctx))
+	assert.Empty(t, kv.keys(), "expired record is removed")
+}
+
+func TestLegacyHeartbeats(t *testing.T) {
+	kv := newMemKV()
+	e := newTestBackend(t, kv)
+	ctx := context.Background()
+
+	other := &parser.Lease{Name: "other", Address: netaddr.MustParseIP("10.0.0.2")}
+	ended := &parser.Lease{Name: "ended", Address: netaddr.MustParseIP("10.0.0.3"), Ends: time.Now().Add(-time.Minute)}
+	for _, lease := range []*parser.Lease{testLease, other, ended} {
+		assert.NoError(t, e.Put(ctx, lease))
+	}
+
+	// earlier versions wrote the time of the write instead of the deadline
+	_, err := kv.Put(ctx, testRecordKeys[0], fmt.Sprint(time.Now().Add(-e.leaseTimeout/2).Unix()))
+	assert.NoError(t, err)
+	_, err = kv.Put(ctx, "/dhcpd/run/other/0a000002", fmt.Sprint(time.Now().Add(-2*e.leaseTimeout).Unix()))
+	assert.NoError(t, err)
+
+	assert.NoError(t, e.Cleanup(ctx))
+	assert.Equal(t, testRecordKeys, kv.keys(), "legacy heartbeats expire the lease timeout after their write")
+
+	records, err := e.List(ctx)
+	if assert.NoError(t, err) && assert.Len(t, records, 1) {
+		assert.WithinDuration(t, time.Now().Add(e.leaseTimeout/2), records[0].Expires, 2*time.Second)
+	}
+}
+
+func TestDeadlineIsCappedByTimeout(t *testing.T) {
+	kv := newMemKV()
+	e := newTestBackend(t, kv)
+	ctx := context.Background()
+
+	lease := &parser.Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1"), Ends: time.Now().Add(24 * time.Hour)}
+	assert.NoError(t, e.Put(ctx, lease))
+
+	records, err := e.List(ctx)
+	if assert.NoError(t, err) && assert.Len(t, records, 1) {
+		assert.WithinDuration(t, time.Now().Add(e.leaseTimeout), records[0].Expires, 2*time.Second,
+			"record of a long lease expires unless it is refreshed within the lease timeout")
+	}
+}
+
+func newTestLeaseBackend(t *testing.T, kv *memKV) *etcdBackend {
+	e := newTestBackend(t, kv)
+	e.lessor = kv
+	e.expiry = ExpiryLease
+	e.cleanupInterval = time.Minute
+	e.init(nil)
+	return e
+}
+
+func TestGrant(t *testing.T) {
+	kv := newMemKV()
+	e := newTestLeaseBackend(t, kv)
+	ctx := context.Background()
+	otherKey := "/skydns/test/run/other/0a000002"
+
+	// the lease ends a little before the end of a cleanup interval
+	ends := e.bucket(time.Now().Add(30 * time.Second)).Add(-2 * time.Second)
+	ending := &parser.Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1"), Ends: ends}
+	id, err := e.grant(ctx, testRecordKeys[2], ending)
+	assert.NoError(t, err)
+	bucket := e.bucket(ends)
+	assert.False(t, bucket.Before(ends))
+	assert.True(t, bucket.Before(ends.Add(e.cleanupInterval)), "lease end is rounded up to the cleanup interval")
+	assert.InDelta(t, time.Until(bucket).Seconds(), kv.leases[id].ttl, 1, "TTL runs to the rounded lease end")
+
+	requests := kv.requests
+	other := &parser.Lease{Name: "other", Address: netaddr.MustParseIP("10.0.0.2"), Ends: ends.Add(time.Second)}
+	shared, err := e.grant(ctx, otherKey, other)
+	assert.NoError(t, err)
+	assert.Equal(t, id, shared, "leases ending within the same interval share their grant")
+	assert.Equal(t, requests, kv.requests, "shared grant needs no request")
+
+	long := &parser.Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1"), Ends: time.Now().Add(24 * time.Hour)}
+	live, err := e.grant(ctx, testRecordKeys[2], long)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, live, "long lease gets the live grant")
+	assert.Equal(t, int64((2 * time.Minute).Seconds()), kv.leases[live].ttl,
+		"TTL of the live grant is the lease timeout extended by the cleanup interval")
+
+	requests = kv.requests
+	reused, err := e.grant(ctx, otherKey, testLease)
+	assert.NoError(t, err)
+	assert.Equal(t, live, reused, "lease that never ends shares the live grant")
+	assert.Equal(t, requests, kv.requests, "shared grant needs no request")
+
+	kv.leases[live].expires = time.Now().Add(time.Second)
+	assert.NoError(t, e.Flush(ctx))
+	assert.Equal(t, requests+1, kv.requests, "flush keeps the live grant alive with a single request")
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), kv.leases[live].expires, time.Second, "grant is renewed")
+
+	kv.expire(live)
+	assert.NoError(t, e.Flush(ctx))
+	regranted, err := e.grant(ctx, testRecordKeys[2], testLease)
+	assert.NoError(t, err)
+	assert.NotEqual(t, live, regranted, "revoked grant is replaced")
+}
+
+func TestCleanupInLeaseMode(t *testing.T) {
+	kv := newMemKV()
+	e := newTestLeaseBackend(t, kv)
+	ctx := context.Background()
+
+	other := &parser.Lease{Name: "other", Address: netaddr.MustParseIP("10.0.0.2")}
+	assert.NoError(t, e.Put(ctx, testLease))
+	assert.NoError(t, e.Put(ctx, other))
+	id := clientv3.LeaseID(kv.kvs[testRecordKeys[2]].Lease)
+
+	// the lease has disappeared from the lease file
+	e.attached[testRecordKeys[2]].deadline = time.Now().Add(-time.Second)
+	assert.NoError(t, e.Cleanup(ctx))
+	assert.Equal(t, []string{"/skydns/arpa/in-addr/10/0/0/2/other.run.test", "/skydns/test/run/other/0a000002"}, kv.keys(),
+		"record that has not been refreshed is removed with its PTR record")
+	assert.Contains(t, kv.leases, id, "live grant is kept for the other records")
+}
+
+func TestPutSkipsUnchangedRecords(t *testing.T) {
+	kv := newMemKV()
+	e := newTestBackend(t, kv)
+	e.watcher = kv
+	e.init(nil)
+	defer e.cache.close()
+	ctx := context.Background()
+
+	leases := []*parser.Lease{
+		testLease,
+		{Name: "other", Address: netaddr.MustParseIP("10.0.0.2")},
+	}
+	for _, lease := range leases {
+		assert.NoError(t, e.Put(ctx, lease))
+	}
+	assert.NoError(t, e.Flush(ctx))
+
+	assert.Eventually(t, func() bool {
+		for _, key := range testRecordKeys {
+			if _, ok := e.cache.get(key); !ok {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond, "cache is in sync")
+
+	// heartbeats that lag little behind the deadline are not refreshed
+	requests := kv.requests
+	for _, lease := range leases {
+		assert.NoError(t, e.Put(ctx, lease))
+	}
+	assert.NoError(t, e.Flush(ctx))
+	assert.Equal(t, requests, kv.requests, "unchanged records are not written")
+
+	stale := heartbeatValue(backend.Deadline(testLease, time.Now(), e.leaseTimeout).Add(-e.leaseTimeout / 2))
+	_, err := kv.Put(ctx, testRecordKeys[0], stale)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		kv, ok := e.cache.get(testRecordKeys[0])
+		return ok && string(kv.Value) == stale
+	}, time.Second, 10*time.Millisecond, "cache follows the stale heartbeat")
+
+	requests = kv.requests
+	for _, lease := range leases {
+		assert.NoError(t, e.Put(ctx, lease))
+	}
+	assert.Equal(t, requests, kv.requests, "stale heartbeats are queued")
+
+	assert.NoError(t, e.Flush(ctx))
+	assert.Equal(t, requests+1, kv.requests, "heartbeats are refreshed in a single transaction")
+
+	resp, err := kv.Get(ctx, testRecordKeys[0])
+	if assert.NoError(t, err) && assert.Len(t, resp.Kvs, 1) {
+		assert.Equal(t, heartbeatValue(backend.Deadline(testLease, time.Now(), e.leaseTimeout)), string(resp.Kvs[0].Value), "heartbeat is refreshed")
+	}
+
+	// records that are not cached are written right away
+	renamed := &parser.Lease{Name: "renamed", Address: netaddr.MustParseIP("10.0.0.1")}
+	requests = kv.requests
+	assert.NoError(t, e.Put(ctx, renamed))
+	assert.Equal(t, requests+1, kv.requests, "new record is written")
+}
+
+func TestSourcesShareCache(t *testing.T) {
+	kv := newMemKV()
+	e := newTestBackend(t, kv)
+	e.watcher = kv
+	e.init(nil)
+	ctx := context.Background()
+
+	source := e.ForSource(&config.LeaseConfig{Name: "other", Zone: "/skydns/test/other/"})
+	assert.Same(t, e.cache, source.cache, "sources use the cache of their backend")
+	assert.Contains(t, e.cache.prefixes, "/skydns/test/other/")
+	assert.NotContains(t, e.cache.prefixes, "/dhcpd/run/other/", "prefixes below followed prefixes are covered")
+
+	assert.NoError(t, source.Put(ctx, testLease))
+	assert.Eventually(t, func() bool {
+		_, ok := e.cache.get("/skydns/test/other/host/0a000001")
+		return ok
+	}, time.Second, 10*time.Millisecond, "cache follows the prefixes of sources")
+
+	assert.NoError(t, source.Close(ctx))
+	_, ok := e.cache.get("/skydns/test/other/host/0a000001")
+	assert.True(t, ok, "closing a source keeps the shared cache")
+
+	assert.NoError(t, e.Close(ctx))
+}
+
+func TestReconcile(t *testing.T) {
+	kv := newMemKV()
+	e := newTestBackend(t, kv)
+	ctx := context.Background()
+
+	other := &parser.Lease{Name: "other", Address: netaddr.MustParseIP("10.0.0.2")}
+	assert.NoError(t, e.Put(ctx, other))
+
+	diff, err := e.Reconcile(ctx, []backend.Lease{testLease, other})
+	assert.NoError(t, err)
+	assert.Equal(t, []backend.Lease{testLease}, diff.Added)
+	assert.Empty(t, diff.Updated)
+	assert.Empty(t, diff.Deleted)
+
+	diff, err = e.Reconcile(ctx, []backend.Lease{testLease})
+	assert.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	if assert.Len(t, diff.Deleted, 1) {
+		assert.Equal(t, "other", diff.Deleted[0].GetName())
+		assert.Equal(t, other.Address, diff.Deleted[0].GetAddress())
+	}
+	assert.Equal(t, testRecordKeys, kv.keys(), "released lease is removed right away")
+
+	// records of other writers are left alone
+	_, err = kv.Put(ctx, "/skydns/test/run/foreign/0a000003", `{"host":"10.0.0.3"}`)
+	assert.NoError(t, err)
+	diff, err = e.Reconcile(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, diff.Deleted, 1)
+	assert.Equal(t, []string{"/skydns/test/run/foreign/0a000003"}, kv.keys())
+}
+
+func TestLeasesAfterRestart(t *testing.T) {
+	kv := newMemKV()
+	ctx := context.Background()
+
+	other := &parser.Lease{Name: "other", Address: netaddr.MustParseIP("10.0.0.2")}
+	previous := newTestLeaseBackend(t, kv)
+	assert.NoError(t, previous.Put(ctx, testLease))
+	assert.NoError(t, previous.Put(ctx, other))
+	id := clientv3.LeaseID(kv.kvs[testRecordKeys[2]].Lease)
+
+	// records of other writers are left alone
+	_, err := kv.Put(ctx, "/skydns/test/run/foreign/0a000003", `{"host":"10.0.0.3"}`)
+	assert.NoError(t, err)
+
+	e := newTestLeaseBackend(t, kv)
+	records, err := e.List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2, "records of the previous process are listed") {
+		assert.Equal(t, "host (10.0.0.1)", records[0].String())
+		assert.WithinDuration(t, time.Now().Add(2*time.Minute), records[0].Expires, time.Second,
+			"record expires with its etcd lease")
+	}
+
+	assert.NoError(t, e.Delete(ctx, testLease))
+	assert.Contains(t, kv.leases, id, "etcd lease shared with other records is left to expire")
+
+	diff, err := e.Reconcile(ctx, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, diff.Deleted, 1) {
+		assert.Equal(t, "other", diff.Deleted[0].GetName())
+	}
+	assert.Equal(t, []string{"/skydns/test/run/foreign/0a000003"}, kv.keys())
+}
+
+func TestLeasesOfSources(t *testing.T) {
+	kv := newMemKV()
+	e := newTestLeaseBackend(t, kv)
+	ctx := context.Background()
+
+	a := e.ForSource(backendtest.Source("a", "/skydns/test/run/"))
+	b := e.ForSource(backendtest.Source("b", "/skydns/test/run/"))
+	other := &parser.Lease{Name: "other", Address: netaddr.MustParseIP("10.0.0.2")}
+	assert.NoError(t, a.Put(ctx, testLease))
+	assert.NoError(t, b.Put(ctx, other))
+
+	records, err := a.List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1, "records of other sources are not listed") {
+		assert.Equal(t, "host (10.0.0.1)", records[0].String())
+	}
+
+	diff, err := a.Reconcile(ctx, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, diff.Deleted, 1) {
+		assert.Equal(t, "host", diff.Deleted[0].GetName())
+	}
+
+	records, err = b.List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1, "records of other sources survive a reconcile") {
+		assert.Equal(t, "other (10.0.0.2)", records[0].String())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		return newTestBackend(t, newMemKV())
+	})
+}
+
+func TestConformanceCached(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		kv := newMemKV()
+		e := newTestBackend(t, kv)
+		e.watcher = kv
+		e.init(nil)
+		return e
+	})
+}
+
+func TestConformanceLeases(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		return newTestLeaseBackend(t, newMemKV())
+	})
+}
@@ -0,0 +1,135 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// maxTxnOps is the default limit of operations in a transaction of etcd.
+const maxTxnOps = 128
+
+// heartbeat is the new value of a heartbeat key that is known to exist.
+type heartbeat struct {
+	value string
+	// modRevision is the revision of the cached key, the heartbeat is only
+	// written if the key has not been changed or removed since
+	modRevision int64
+}
+
+// deadlinePrefix marks heartbeat values holding the deadline of a record.
+// Heartbeats without it have been written by earlier versions and hold the
+// time of the write.
+const deadlinePrefix = "deadline:"
+
+func heartbeatValue(deadline time.Time) string {
+	return deadlinePrefix + fmt.Sprint(deadline.Unix())
+}
+
+// parseHeartbeat returns the deadline of a heartbeat value. legacy is set for
+// values holding the time of their write, which expire the lease timeout
+// after it.
+func (e *etcdBackend) parseHeartbeat(value string) (deadline time.Time, legacy bool, err error) {
+	seconds, err := strconv.ParseInt(strings.TrimPrefix(value, deadlinePrefix), 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !strings.HasPrefix(value, deadlinePrefix) {
+		return time.Unix(seconds, 0).UTC().Add(e.leaseTimeout), true, nil
+	}
+	return time.Unix(seconds, 0).UTC(), false, nil
+}
+
+// heartbeatLag is the fraction of the lease timeout that the heartbeat of a
+// lease may lag behind its deadline before it is refreshed. Otherwise the
+// heartbeats of leases that never end would be written on every sync.
+const heartbeatLag = 10
+
+// refresh queues a new heartbeat for the next Flush unless the cached
+// heartbeat is recent enough. It reports false if the heartbeat key is not
+// cached and has to be written with its record.
+func (e *etcdBackend) refresh(configKey string, deadline time.Time) bool {
+	kv, ok := e.cache.get(configKey)
+	if !ok {
+		return false
+	}
+
+	if cached, legacy, err := e.parseHeartbeat(string(kv.Value)); err == nil && !legacy {
+		lag := deadline.Unix() - cached.Unix()
+		if lag >= 0 && time.Duration(lag)*time.Second <= e.leaseTimeout/heartbeatLag {
+			return true
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.heartbeats[configKey] = &heartbeat{value: heartbeatValue(deadline), modRevision: kv.ModRevision}
+	return true
+}
+
+// Flush writes the heartbeats queued by Put in batched transactions. Without
+// heartbeats it keeps the live grant alive.
+func (e *etcdBackend) Flush(ctx context.Context) error {
+	logger := e.logger.WithOptions(zap.Fields(zap.String("op", "etcd.Flush")))
+
+	if e.expiry == ExpiryLease {
+		return e.keepAlive(ctx)
+	}
+
+	e.mu.Lock()
+	heartbeats := e.heartbeats
+	e.heartbeats = make(map[string]*heartbeat)
+	e.mu.Unlock()
+
+	keys := make([]string, 0, len(heartbeats))
+	for key := range heartbeats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for start := 0; start < len(keys); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		cmps := make([]clientv3.Cmp, 0, end-start)
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, key := range keys[start:end] {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", heartbeats[key].modRevision))
+			ops = append(ops, clientv3.OpPut(key, heartbeats[key].value))
+		}
+
+		resp, err := e.kv.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if !resp.Succeeded {
+			// a heartbeat has been removed or written meanwhile, the next
+			// sync writes the affected records again
+			logger.Info("heartbeats changed during refresh, retrying one by one", zap.Int("count", end-start))
+			e.flushEach(ctx, keys[start:end], heartbeats)
+			continue
+		}
+		logger.Debug("refreshed heartbeats", zap.Int("count", end-start))
+	}
+	return nil
+}
+
+func (e *etcdBackend) flushEach(ctx context.Context, keys []string, heartbeats map[string]*heartbeat) {
+	for _, key := range keys {
+		_, err := e.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", heartbeats[key].modRevision)).
+			Then(clientv3.OpPut(key, heartbeats[key].value)).
+			Commit()
+		if err != nil {
+			e.logger.Warn("failed to refresh heartbeat", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
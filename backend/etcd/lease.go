@@ -0,0 +1,214 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// ExpiryHeartbeat removes records whose heartbeat key has expired during
+	// Cleanup
+	ExpiryHeartbeat = "heartbeat"
+	// ExpiryLease attaches records to etcd leases, so that etcd removes
+	// them itself
+	ExpiryLease = "lease"
+)
+
+// grant is an etcd lease that records are attached to. The records of a
+// source share their grants, so that the number of etcd leases and the
+// requests keeping them alive do not grow with the number of records.
+type grant struct {
+	id clientv3.LeaseID
+	// expires is when etcd revokes the grant unless it is kept alive
+	expires time.Time
+}
+
+// attachment is the grant the record of a key is attached to.
+type attachment struct {
+	grant *grant
+	// deadline is when the record is removed unless it is refreshed
+	deadline time.Time
+}
+
+// grant returns the etcd lease to attach the record of a DHCP lease to.
+//
+// The deadlines of the records are kept in memory and Cleanup removes the
+// records whose deadline has passed, just like their heartbeats would
+// expire. The grants make etcd remove the records itself if the backend
+// stops: the records of leases that end within the lease timeout share a
+// grant that runs to the end of the lease, rounded up to the cleanup
+// interval, and is never kept alive. All other records share the live grant
+// of the backend, which Flush keeps alive once per sync. Its TTL is the
+// lease timeout extended by a cleanup interval, so that the sync keeping it
+// alive does not race its expiry.
+func (e *etcdBackend) grant(ctx context.Context, key string, lease backend.Lease) (clientv3.LeaseID, error) {
+	now := time.Now()
+	keepAliveTTL := e.leaseTimeout + e.cleanupInterval
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// grants are requested while holding mu, so that concurrent puts share
+	// them
+	deadline := backend.Deadline(lease, now, e.leaseTimeout)
+	ends := lease.GetEnds()
+	if ends.IsZero() || !ends.Before(now.Add(keepAliveTTL)) {
+		if e.live == nil || !now.Before(e.live.expires) {
+			g, err := e.newGrant(ctx, now, now.Add(keepAliveTTL))
+			if err != nil {
+				return 0, err
+			}
+			e.live = g
+		}
+		e.attached[key] = &attachment{grant: e.live, deadline: deadline}
+		return e.live.id, nil
+	}
+
+	expires := e.bucket(ends)
+	g, ok := e.ending[expires.Unix()]
+	if !ok || !now.Before(g.expires) {
+		var err error
+		if g, err = e.newGrant(ctx, now, expires); err != nil {
+			return 0, err
+		}
+		e.ending[expires.Unix()] = g
+	}
+	e.attached[key] = &attachment{grant: g, deadline: deadline}
+	return g.id, nil
+}
+
+// newGrant requests an etcd lease that expires at expires, but lasts at
+// least a second. The caller holds mu.
+func (e *etcdBackend) newGrant(ctx context.Context, now, expires time.Time) (*grant, error) {
+	ttl := int64(math.Ceil(expires.Sub(now).Seconds()))
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	resp, err := e.lessor.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	e.logger.Debug("granted etcd lease", zap.String("op", "etcd.grant"),
+		zap.Int64("id", int64(resp.ID)), zap.Int64("ttl", resp.TTL))
+	return &grant{id: resp.ID, expires: expires}, nil
+}
+
+// bucket rounds the end of a lease up to the cleanup interval, so that
+// leases ending within the same interval share their grant.
+func (e *etcdBackend) bucket(ends time.Time) time.Time {
+	width := int64(e.cleanupInterval / time.Second)
+	if width < 1 {
+		width = 1
+	}
+
+	seconds := ends.Unix()
+	if ends.Nanosecond() > 0 {
+		seconds++
+	}
+	if rest := seconds % width; rest != 0 {
+		seconds += width - rest
+	}
+	return time.Unix(seconds, 0).UTC()
+}
+
+// keepAlive renews the live grant. A grant that etcd has revoked already is
+// forgotten, the next Put attaches the records to a new one.
+func (e *etcdBackend) keepAlive(ctx context.Context) error {
+	e.mu.Lock()
+	g := e.live
+	e.mu.Unlock()
+	if g == nil {
+		return nil
+	}
+
+	now := time.Now()
+	resp, err := e.lessor.KeepAliveOnce(ctx, g.id)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case errors.Is(err, rpctypes.ErrLeaseNotFound):
+		e.logger.Debug("etcd lease has been revoked", zap.String("op", "etcd.keepAlive"), zap.Int64("id", int64(g.id)))
+		if e.live == g {
+			e.live = nil
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+	g.expires = now.Add(time.Duration(resp.TTL) * time.Second)
+	return nil
+}
+
+// removeExpired removes the records whose deadline has passed, unless they
+// have been attached to another etcd lease meanwhile.
+func (e *etcdBackend) removeExpired(ctx context.Context) error {
+	logger := e.logger.WithOptions(zap.Fields(zap.String("op", "etcd.removeExpired")))
+
+	e.mu.Lock()
+	now := time.Now()
+	expired := map[string]clientv3.LeaseID{}
+	for key, a := range e.attached {
+		if now.After(a.deadline) {
+			expired[key] = a.grant.id
+			delete(e.attached, key)
+		}
+	}
+	e.mu.Unlock()
+
+	for key, id := range expired {
+		logger.Info("remove expired lease", zap.String("key", key))
+
+		ops := []clientv3.Op{clientv3.OpDelete(key)}
+		if reverseKey, ok := e.reverseKeyOf(key, e.dnsPrefix); ok {
+			ops = append(ops, clientv3.OpDelete(reverseKey))
+		}
+		_, err := e.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.LeaseValue(key), "=", id)).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeExpiredGrants revokes and forgets the grants that have expired by
+// now. etcd rounds their TTL up to full seconds and would revoke them a
+// little later.
+func (e *etcdBackend) revokeExpiredGrants(ctx context.Context) error {
+	e.mu.Lock()
+	now := time.Now()
+	expired := []clientv3.LeaseID{}
+	for bucket, g := range e.ending {
+		if now.After(g.expires) {
+			expired = append(expired, g.id)
+			delete(e.ending, bucket)
+		}
+	}
+	if e.live != nil && now.After(e.live.expires) {
+		expired = append(expired, e.live.id)
+		e.live = nil
+	}
+	for key, a := range e.attached {
+		if now.After(a.grant.expires) {
+			delete(e.attached, key)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, id := range expired {
+		if _, err := e.lessor.Revoke(ctx, id); err != nil && !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// memKV is an in-memory clientv3.KV for tests that also grants etcd leases.
+// Every call is a request that can be made to fail with failAt. Ranges are
+// returned sorted by value, the only order the backend asks for.
+type memKV struct {
+	mu  sync.Mutex
+	rev int64
+	kvs map[string]*mvccpb.KeyValue
+
+	leaseID clientv3.LeaseID
+	// leases holds the expiry of every granted lease
+	leases map[clientv3.LeaseID]*memLease
+
+	requests int
+	// failAt makes the request with this number fail without applying it
+	failAt int
+	// beforeTxn is called before a transaction is applied
+	beforeTxn func(kv *memKV)
+	// lastTxn is the last transaction that has been committed
+	lastTxn clientv3.Op
+
+	history []*clientv3.Event
+	watches []*memWatch
+	// dispatched is the number of events of history sent to the watches
+	dispatched int
+}
+
+type memLease struct {
+	ttl     int64
+	expires time.Time
+}
+
+var (
+	_ clientv3.KV      = &memKV{}
+	_ clientv3.Watcher = &memKV{}
+	_ clientv3.Lease   = &memKV{}
+)
+
+const (
+	errInjected    = Error("injected failure")
+	errUnsupported = Error("not supported by memKV")
+)
+
+func newMemKV() *memKV {
+	return &memKV{kvs: make(map[string]*mvccpb.KeyValue), leases: make(map[clientv3.LeaseID]*memLease)}
+}
+
+func (m *memKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpPut(key, val, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Put(), nil
+}
+
+func (m *memKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpGet(key, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Get(), nil
+}
+
+func (m *memKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpDelete(key, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Del(), nil
+}
+
+func (m *memKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return &clientv3.CompactResponse{}, nil
+}
+
+func (m *memKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	m.mu.Lock()
+	defer m.dispatch()
+	defer m.mu.Unlock()
+
+	if err := m.request(); err != nil {
+		return clientv3.OpResponse{}, err
+	}
+
+	m.rev += 1
+	switch resp := m.apply(op).Response.(type) {
+	case *etcdserverpb.ResponseOp_ResponsePut:
+		return (*clientv3.PutResponse)(resp.ResponsePut).OpResponse(), nil
+	case *etcdserverpb.ResponseOp_ResponseRange:
+		return (*clientv3.GetResponse)(resp.ResponseRange).OpResponse(), nil
+	case *etcdserverpb.ResponseOp_ResponseDeleteRange:
+		return (*clientv3.DeleteResponse)(resp.ResponseDeleteRange).OpResponse(), nil
+	case *etcdserverpb.ResponseOp_ResponseTxn:
+		return (*clientv3.TxnResponse)(resp.ResponseTxn).OpResponse(), nil
+	}
+	return clientv3.OpResponse{}, nil
+}
+
+func (m *memKV) Txn(ctx context.Context) clientv3.Txn {
+	return &memTxn{kv: m, ctx: ctx}
+}
+
+func (m *memKV) request() error {
+	m.requests += 1
+	if m.requests == m.failAt {
+		return errInjected
+	}
+	return nil
+}
+
+// keys returns the stored keys in order.
+func (m *memKV) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := []string{}
+	for key := range m.kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *memKV) inRange(op clientv3.Op, key []byte) bool {
+	end := op.RangeBytes()
+	if len(end) == 0 {
+		return bytes.Equal(key, op.KeyBytes())
+	}
+	return bytes.Compare(key, op.KeyBytes()) >= 0 && (bytes.Equal(end, []byte{0}) || bytes.Compare(key, end) < 0)
+}
+
+func (m *memKV) apply(op clientv3.Op) *etcdserverpb.ResponseOp {
+	switch {
+	case op.IsPut():
+		key := string(op.KeyBytes())
+		kv := &mvccpb.KeyValue{Key: op.KeyBytes(), Value: op.ValueBytes(), CreateRevision: m.rev, ModRevision: m.rev, Version: 1,
+			Lease: opLease(op)}
+		if previous, ok := m.kvs[key]; ok {
+			kv.CreateRevision = previous.CreateRevision
+			kv.Version = previous.Version + 1
+		}
+		m.kvs[key] = kv
+		m.history = append(m.history, &clientv3.Event{Type: clientv3.EventTypePut, Kv: kv})
+		return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponsePut{
+			ResponsePut: &etcdserverpb.PutResponse{}}}
+
+	case op.IsGet():
+		resp := &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{Revision: m.rev}}
+		for _, kv := range m.kvs {
+			if m.inRange(op, kv.Key) {
+				resp.Kvs = append(resp.Kvs, kv)
+			}
+		}
+		sort.Slice(resp.Kvs, func(i, j int) bool {
+			if c := bytes.Compare(resp.Kvs[i].Value, resp.Kvs[j].Value); c != 0 {
+				return c < 0
+			}
+			return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0
+		})
+		resp.Count = int64(len(resp.Kvs))
+		if op.IsCountOnly() {
+			resp.Kvs = nil
+		}
+		return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseRange{ResponseRange: resp}}
+
+	case op.IsDelete():
+		resp := &etcdserverpb.DeleteRangeResponse{}
+		for key, kv := range m.kvs {
+			if m.inRange(op, kv.Key) {
+				delete(m.kvs, key)
+				resp.Deleted += 1
+				m.history = append(m.history, &clientv3.Event{Type: clientv3.EventTypeDelete,
+					Kv: &mvccpb.KeyValue{Key: kv.Key, ModRevision: m.rev}})
+			}
+		}
+		return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: resp}}
+
+	case op.IsTxn():
+		cmps, then, otherwise := op.Txn()
+		return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseTxn{
+			ResponseTxn: m.applyTxn(cmps, then, otherwise)}}
+	}
+	return &etcdserverpb.ResponseOp{}
+}
+
+func (m *memKV) applyTxn(cmps []clientv3.Cmp, then, otherwise []clientv3.Op) *etcdserverpb.TxnResponse {
+	resp := &etcdserverpb.TxnResponse{Succeeded: true}
+	for _, cmp := range cmps {
+		if !m.compare(cmp) {
+			resp.Succeeded = false
+			break
+		}
+	}
+
+	ops := then
+	if !resp.Succeeded {
+		ops = otherwise
+	}
+	for _, op := range ops {
+		resp.Responses = append(resp.Responses, m.apply(op))
+	}
+	return resp
+}
+
+func (m *memKV) compare(cmp clientv3.Cmp) bool {
+	kv, ok := m.kvs[string(cmp.KeyBytes())]
+	if !ok {
+		// the revisions of missing keys are zero
+		kv = &mvccpb.KeyValue{}
+	}
+
+	var result int
+	switch target := cmp.TargetUnion.(type) {
+	case *etcdserverpb.Compare_Value:
+		if !ok {
+			return false
+		}
+		result = bytes.Compare(kv.Value, target.Value)
+	case *etcdserverpb.Compare_CreateRevision:
+		result = compareInt(kv.CreateRevision, target.CreateRevision)
+	case *etcdserverpb.Compare_ModRevision:
+		result = compareInt(kv.ModRevision, target.ModRevision)
+	case *etcdserverpb.Compare_Version:
+		result = compareInt(kv.Version, target.Version)
+	case *etcdserverpb.Compare_Lease:
+		result = compareInt(kv.Lease, target.Lease)
+	}
+
+	switch cmp.Result {
+	case etcdserverpb.Compare_EQUAL:
+		return result == 0
+	case etcdserverpb.Compare_GREATER:
+		return result > 0
+	case etcdserverpb.Compare_LESS:
+		return result < 0
+	case etcdserverpb.Compare_NOT_EQUAL:
+		return result != 0
+	}
+	return false
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type memTxn struct {
+	kv        *memKV
+	ctx       context.Context
+	cmps      []clientv3.Cmp
+	then      []clientv3.Op
+	otherwise []clientv3.Op
+}
+
+func (t *memTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *memTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *memTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.otherwise = append(t.otherwise, ops...)
+	return t
+}
+
+func (t *memTxn) Commit() (*clientv3.TxnResponse, error) {
+	if t.kv.beforeTxn != nil {
+		t.kv.beforeTxn(t.kv)
+	}
+
+	txn := clientv3.OpTxn(t.cmps, t.then, t.otherwise)
+	t.kv.mu.Lock()
+	t.kv.lastTxn = txn
+	t.kv.mu.Unlock()
+
+	resp, err := t.kv.Do(t.ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Txn(), nil
+}
+
+type memWatch struct {
+	ctx context.Context
+	op  clientv3.Op
+	ch  chan clientv3.WatchResponse
+}
+
+// Watch sends the events of the keys in range from the requested revision
+// on.
+func (m *memKV) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	m.mu.Lock()
+	// the options of a watch are those of a get
+	watch := &memWatch{ctx: ctx, op: clientv3.OpGet(key, opts...), ch: make(chan clientv3.WatchResponse, 1024)}
+	m.watches = append(m.watches, watch)
+
+	events := []*clientv3.Event{}
+	for _, event := range m.history[:m.dispatched] {
+		if event.Kv.ModRevision >= watch.op.Rev() && m.inRange(watch.op, event.Kv.Key) {
+			events = append(events, event)
+		}
+	}
+	if len(events) > 0 {
+		watch.ch <- clientv3.WatchResponse{Events: events}
+	}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, w := range m.watches {
+			if w == watch {
+				m.watches = append(m.watches[:i], m.watches[i+1:]...)
+				close(watch.ch)
+				break
+			}
+		}
+	}()
+	return watch.ch
+}
+
+// dispatch sends the events that have not been sent yet to the watches.
+func (m *memKV) dispatch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := m.history[m.dispatched:]
+	m.dispatched = len(m.history)
+	for _, watch := range m.watches {
+		matching := []*clientv3.Event{}
+		for _, event := range events {
+			if m.inRange(watch.op, event.Kv.Key) {
+				matching = append(matching, event)
+			}
+		}
+		if len(matching) > 0 {
+			watch.ch <- clientv3.WatchResponse{Events: matching}
+		}
+	}
+}
+
+func (m *memKV) RequestProgress(ctx context.Context) error {
+	return nil
+}
+
+func (m *memKV) Close() error {
+	return nil
+}
+
+// opLease returns the etcd lease of a put, which clientv3 does not export.
+func opLease(op clientv3.Op) int64 {
+	return reflect.ValueOf(op).FieldByName("leaseID").Int()
+}
+
+// Grant grants a lease that expires after ttl seconds unless it is kept
+// alive.
+func (m *memKV) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.request(); err != nil {
+		return nil, err
+	}
+	m.leaseID += 1
+	m.leases[m.leaseID] = &memLease{ttl: ttl, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	return &clientv3.LeaseGrantResponse{ID: m.leaseID, TTL: ttl}, nil
+}
+
+// lease returns a lease that has not expired yet. Expired leases are revoked.
+// The caller holds mu.
+func (m *memKV) lease(id clientv3.LeaseID) (*memLease, error) {
+	lease, ok := m.leases[id]
+	if ok && time.Now().After(lease.expires) {
+		m.revoke(id)
+		ok = false
+	}
+	if !ok {
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+	return lease, nil
+}
+
+// revoke removes a lease together with its keys. The caller holds mu.
+func (m *memKV) revoke(id clientv3.LeaseID) {
+	delete(m.leases, id)
+	m.rev += 1
+	for key, kv := range m.kvs {
+		if kv.Lease == int64(id) {
+			delete(m.kvs, key)
+			m.history = append(m.history, &clientv3.Event{Type: clientv3.EventTypeDelete,
+				Kv: &mvccpb.KeyValue{Key: kv.Key, ModRevision: m.rev}})
+		}
+	}
+}
+
+// expire makes a lease expire as if its TTL had passed.
+func (m *memKV) expire(id clientv3.LeaseID) {
+	defer m.dispatch()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lease, ok := m.leases[id]; ok {
+		lease.expires = time.Now().Add(-time.Second)
+	}
+}
+
+func (m *memKV) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	defer m.dispatch()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.request(); err != nil {
+		return nil, err
+	}
+	if _, err := m.lease(id); err != nil {
+		return nil, err
+	}
+	m.revoke(id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (m *memKV) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	defer m.dispatch()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.request(); err != nil {
+		return nil, err
+	}
+	lease, err := m.lease(id)
+	if err != nil {
+		// etcd reports a TTL of -1 for leases that do not exist
+		return &clientv3.LeaseTimeToLiveResponse{ID: id, TTL: -1}, nil
+	}
+	ttl := int64(time.Until(lease.expires).Round(time.Second).Seconds())
+	return &clientv3.LeaseTimeToLiveResponse{ID: id, TTL: ttl, GrantedTTL: lease.ttl}, nil
+}
+
+func (m *memKV) Leases(ctx context.Context) (*clientv3.LeaseLeasesResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resp := &clientv3.LeaseLeasesResponse{}
+	for id := range m.leases {
+		resp.Leases = append(resp.Leases, clientv3.LeaseStatus{ID: id})
+	}
+	return resp, nil
+}
+
+// KeepAlive is not supported, the backend keeps leases alive with
+// KeepAliveOnce.
+func (m *memKV) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	return nil, errUnsupported
+}
+
+// KeepAliveOnce resets the expiry of a lease to its TTL.
+func (m *memKV) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	defer m.dispatch()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.request(); err != nil {
+		return nil, err
+	}
+	lease, err := m.lease(id)
+	if err != nil {
+		return nil, err
+	}
+	lease.expires = time.Now().Add(time.Duration(lease.ttl) * time.Second)
+	return &clientv3.LeaseKeepAliveResponse{ID: id, TTL: lease.ttl}, nil
+}
@@ -0,0 +1,129 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// Reconcile removes the records of other leases right away instead of
+// waiting for them to expire.
+func (e *etcdBackend) Reconcile(ctx context.Context, leases []backend.Lease) (*backend.Diff, error) {
+	logger := e.logger.WithOptions(zap.Fields(zap.String("op", "etcd.Reconcile")))
+
+	owned, err := e.owned(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// stale holds the records of the leases returned by Stale
+	stale := make(map[backend.Lease]*mvccpb.KeyValue)
+	diff, err := backend.Reconciler{
+		Logger: logger,
+		Key:    func(lease backend.Lease) string { return backend.BuildKey(lease, e.dnsPrefix) },
+		Put:    e.put,
+		Stale: func(desired map[string]struct{}) []backend.Lease {
+			keys := make([]string, 0, len(owned))
+			for key := range owned {
+				if _, ok := desired[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+
+			leases := make([]backend.Lease, 0, len(keys))
+			for _, key := range keys {
+				lease, err := leaseFromKey(key, e.dnsPrefix)
+				if err != nil {
+					logger.Warn("skipping unknown key", zap.String("key", key), zap.Error(err))
+					continue
+				}
+				stale[lease] = owned[key]
+				leases = append(leases, lease)
+			}
+			return leases
+		},
+		Delete: func(ctx context.Context, lease backend.Lease) error {
+			if e.expiry == ExpiryLease {
+				return e.removeRecord(ctx, stale[lease])
+			}
+			return e.remove(ctx, stale[lease])
+		},
+	}.Reconcile(ctx, leases)
+
+	if flushErr := e.Flush(ctx); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	return diff, err
+}
+
+// owned returns the keys of the records written by the backend together with
+// their heartbeats. Without heartbeats these are the records attached to an
+// etcd lease, whose content is the one the backend writes for their key
+// including the name of its source, together with themselves.
+func (e *etcdBackend) owned(ctx context.Context) (map[string]*mvccpb.KeyValue, error) {
+	owned := make(map[string]*mvccpb.KeyValue)
+
+	if e.expiry == ExpiryLease {
+		resp, err := e.kv.Get(ctx, e.dnsPrefix, clientv3.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			if kv.Lease != 0 && e.wrote(kv) {
+				owned[string(kv.Key)] = kv
+			}
+		}
+		return owned, nil
+	}
+
+	resp, err := e.kv.Get(ctx, e.configPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		owned[strings.Replace(string(kv.Key), e.configPrefix, e.dnsPrefix, 1)] = kv
+	}
+	return owned, nil
+}
+
+// wrote reports whether the record has the content the backend writes for
+// the lease of its key, so that it belongs to the source of the backend.
+func (e *etcdBackend) wrote(kv *mvccpb.KeyValue) bool {
+	lease, err := leaseFromKey(string(kv.Key), e.dnsPrefix)
+	if err != nil {
+		return false
+	}
+
+	entry := &hostEntry{}
+	if err := json.Unmarshal(kv.Value, entry); err != nil {
+		return false
+	}
+	return entry.Host == lease.GetAddress().String() && strings.EqualFold(entry.Group, lease.GetName()) &&
+		entry.Source == e.owner
+}
+
+// removeRecord deletes a record without heartbeat together with its PTR
+// record. Its etcd lease is shared with other records and left to expire.
+func (e *etcdBackend) removeRecord(ctx context.Context, record *mvccpb.KeyValue) error {
+	key := string(record.Key)
+	ops := []clientv3.Op{clientv3.OpDelete(key)}
+	if reverseKey, ok := e.reverseKeyOf(key, e.dnsPrefix); ok {
+		ops = append(ops, clientv3.OpDelete(reverseKey))
+	}
+
+	if _, err := e.kv.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	delete(e.attached, key)
+	e.mu.Unlock()
+	return nil
+}
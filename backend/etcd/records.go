@@ -0,0 +1,107 @@
+package etcd
+
+import (
+	"context"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// Delete removes the record of a lease together with its PTR record and
+// heartbeat.
+func (e *etcdBackend) Delete(ctx context.Context, lease backend.Lease) error {
+	key := backend.BuildKey(lease, e.dnsPrefix)
+	if e.expiry == ExpiryLease {
+		resp, err := e.kv.Get(ctx, key)
+		if err != nil || len(resp.Kvs) == 0 {
+			return err
+		}
+		return e.removeRecord(ctx, resp.Kvs[0])
+	}
+
+	ops := []clientv3.Op{clientv3.OpDelete(key), clientv3.OpDelete(backend.BuildKey(lease, e.configPrefix))}
+	if reverseKey, ok := e.reverseKey(lease); ok {
+		ops = append(ops, clientv3.OpDelete(reverseKey))
+	}
+
+	_, err := e.kv.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+// List returns the records written by the backend ordered by name and
+// address. Without heartbeats the records expire with their etcd lease.
+func (e *etcdBackend) List(ctx context.Context) ([]*backend.Record, error) {
+	logger := e.logger.WithOptions(zap.Fields(zap.String("op", "etcd.List")))
+
+	owned, err := e.owned(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*backend.Record, 0, len(owned))
+	for key, kv := range owned {
+		lease, err := leaseFromKey(key, e.dnsPrefix)
+		if err != nil {
+			logger.Warn("skipping unknown key", zap.String("key", key), zap.Error(err))
+			continue
+		}
+
+		record := &backend.Record{Name: lease.GetName(), Address: lease.GetAddress()}
+		if e.expiry == ExpiryLease {
+			expires, err := e.leaseExpiry(ctx, key, clientv3.LeaseID(kv.Lease))
+			if err != nil {
+				return nil, err
+			}
+			if expires.IsZero() {
+				// the record has expired
+				continue
+			}
+			record.Expires = expires
+		} else if deadline, _, err := e.parseHeartbeat(string(kv.Value)); err == nil {
+			record.Expires = deadline
+		}
+		records = append(records, record)
+	}
+
+	backend.SortRecords(records)
+	return records, nil
+}
+
+func (e *etcdBackend) Get(ctx context.Context, name string) ([]*backend.Record, error) {
+	return backend.GetListed(ctx, e, name)
+}
+
+// leaseExpiry returns when the record with the key attached to the etcd
+// lease id is removed, or the zero time if it is due to be. Records attached
+// by this process expire at their deadline, other records when their etcd
+// lease runs out.
+func (e *etcdBackend) leaseExpiry(ctx context.Context, key string, id clientv3.LeaseID) (time.Time, error) {
+	e.mu.Lock()
+	a, ok := e.attached[key]
+	var expired bool
+	var deadline time.Time
+	if ok {
+		now := time.Now()
+		expired = now.After(a.grant.expires) || now.After(a.deadline)
+		deadline = a.deadline
+		ok = a.grant.id == id
+	}
+	e.mu.Unlock()
+	if ok {
+		if expired {
+			return time.Time{}, nil
+		}
+		return deadline, nil
+	}
+
+	resp, err := e.lessor.TimeToLive(ctx, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.TTL <= 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(resp.TTL) * time.Second).UTC(), nil
+}
@@ -0,0 +1,108 @@
+package etcd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"inet.af/netaddr"
+)
+
+// reverseLabels returns the labels of the in-addr.arpa or ip6.arpa name of
+// addr from the top level domain down, i.e. in the order of etcd keys.
+func reverseLabels(addr netaddr.IP) []string {
+	if addr.Is4() {
+		octets := addr.As4()
+		labels := []string{"arpa", "in-addr"}
+		for _, octet := range octets {
+			labels = append(labels, fmt.Sprint(octet))
+		}
+		return labels
+	}
+
+	labels := []string{"arpa", "ip6"}
+	for _, b := range addr.As16() {
+		labels = append(labels, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return labels
+}
+
+// reverseKey returns the key of the PTR record of a lease. Its last element
+// is the name the record points to, so that the records of several names
+// of an address do not replace each other. The second return value is false
+// if no PTR record is written for the address.
+func (e *etcdBackend) reverseKey(lease backend.Lease) (string, bool) {
+	if e.reversePrefix == "" || !e.inReverseZone(lease.GetAddress()) {
+		return "", false
+	}
+
+	key := strings.TrimSuffix(e.reversePrefix, "/")
+	for _, label := range reverseLabels(lease.GetAddress()) {
+		key = fmt.Sprintf("%v/%v", key, label)
+	}
+	return fmt.Sprintf("%v/%v", key, strings.TrimSuffix(e.fqdn(lease), ".")), true
+}
+
+func (e *etcdBackend) inReverseZone(addr netaddr.IP) bool {
+	if len(e.reverseZones) == 0 {
+		return true
+	}
+	for _, zone := range e.reverseZones {
+		if zone.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fqdn returns the fully qualified name of the forward record of a lease.
+func (e *etcdBackend) fqdn(lease backend.Lease) string {
+	if e.domain == "" {
+		return lease.GetName() + "."
+	}
+	return fmt.Sprintf("%v.%v.", lease.GetName(), e.domain)
+}
+
+func (e *etcdBackend) buildReverseEntry(lease backend.Lease) *hostEntry {
+	return &hostEntry{
+		Host: e.fqdn(lease),
+		TTL:  60,
+	}
+}
+
+// keyLease is the lease whose record is stored at a key built by
+// backend.BuildKey.
+type keyLease struct {
+	name    string
+	address netaddr.IP
+}
+
+func (l *keyLease) GetName() string        { return l.name }
+func (l *keyLease) GetAddress() netaddr.IP { return l.address }
+func (l *keyLease) GetEnds() time.Time     { return time.Time{} }
+
+// leaseFromKey reverses backend.BuildKey.
+func leaseFromKey(key, prefix string) (*keyLease, error) {
+	path := strings.Trim(strings.TrimPrefix(key, prefix), "/")
+	elements := strings.Split(path, "/")
+	if len(elements) < 2 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, key)
+	}
+
+	id, err := hex.DecodeString(elements[len(elements)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v: %v", ErrInvalidKey, key, err)
+	}
+	address, ok := netaddr.FromStdIPRaw(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, key)
+	}
+
+	labels := elements[:len(elements)-1]
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return &keyLease{name: strings.Join(labels, "."), address: address}, nil
+}
@@ -0,0 +1,46 @@
+package etcd
+
+import (
+	"testing"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+)
+
+func TestReverseKey(t *testing.T) {
+	e := &etcdBackend{
+		dnsPrefix:     "/skydns/test/run/",
+		configPrefix:  "/dhcpd/run/",
+		reversePrefix: "/skydns/",
+		reverseZones:  []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8"), netaddr.MustParseIPPrefix("2001:db8::/32")},
+	}
+	e.domain = backend.ZoneDomain(e.dnsPrefix, e.reversePrefix)
+	assert.Equal(t, "run.test", e.domain)
+
+	v4 := &parser.Lease{Name: "host", Address: netaddr.MustParseIP("10.1.2.3")}
+	key, ok := e.reverseKey(v4)
+	assert.True(t, ok)
+	assert.Equal(t, "/skydns/arpa/in-addr/10/1/2/3/host.run.test", key)
+	assert.Equal(t, "host.run.test.", e.buildReverseEntry(v4).Host)
+
+	v6 := &parser.Lease{Name: "host", Address: netaddr.MustParseIP("2001:db8::1")}
+	key, ok = e.reverseKey(v6)
+	assert.True(t, ok)
+	assert.Equal(t, "/skydns/arpa/ip6/2/0/0/1/0/d/b/8/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/1/host.run.test", key)
+
+	_, ok = e.reverseKey(&parser.Lease{Name: "host", Address: netaddr.MustParseIP("192.168.0.1")})
+	assert.False(t, ok, "no PTR record outside of the reverse zones")
+
+	for _, lease := range []*parser.Lease{v4, v6} {
+		fromKey, err := leaseFromKey(backend.BuildKey(lease, e.configPrefix), e.configPrefix)
+		if assert.NoError(t, err) {
+			assert.Equal(t, lease.Name, fromKey.GetName())
+			assert.Equal(t, lease.Address, fromKey.GetAddress())
+		}
+	}
+
+	_, err := leaseFromKey("/dhcpd/run/host/xyz", e.configPrefix)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
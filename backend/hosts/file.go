@@ -0,0 +1,204 @@
+package hosts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/util"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// entry is a record of the hosts file together with its heartbeat.
+type entry struct {
+	Source  string     `json:"source"`
+	Name    string     `json:"name"`
+	Address netaddr.IP `json:"address"`
+	Expires time.Time  `json:"expires"`
+}
+
+func (e *entry) GetName() string        { return e.Name }
+func (e *entry) GetAddress() netaddr.IP { return e.Address }
+
+// GetEnds returns the zero time, the state file only keeps the heartbeat.
+func (e *entry) GetEnds() time.Time { return time.Time{} }
+
+// entryKey identifies the record of a lease of a source.
+func entryKey(source string, lease backend.Lease) string {
+	return fmt.Sprintf("%v/%v/%v", source, strings.ToLower(lease.GetName()), backend.LeaseID(lease))
+}
+
+// hostsFile holds the records of all lease sources and writes them to the
+// hosts file and their heartbeats to the state file.
+type hostsFile struct {
+	path, statePath string
+	domain          string
+	// sources maps the names of the lease sources to their domains relative
+	// to domain
+	sources map[string]string
+	logger  *zap.Logger
+
+	mu      sync.Mutex
+	records map[string]*entry
+	// hostsChanged and stateChanged tell which files flush has to write,
+	// refreshed tells that heartbeats have moved since the state was written
+	hostsChanged, stateChanged, refreshed bool
+}
+
+// openHostsFile reads the state file if it exists. The records of sources
+// that are not listed in sources are removed, nothing would refresh or
+// expire them.
+func openHostsFile(path, statePath, domain string, sources map[string]string, logger *zap.Logger) (*hostsFile, error) {
+	f := &hostsFile{
+		path:      path,
+		statePath: statePath,
+		domain:    domain,
+		sources:   sources,
+		logger:    logger.With(zap.String("path", path)),
+		records:   make(map[string]*entry),
+	}
+
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []*entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	for _, e := range entries {
+		if _, ok := sources[e.Source]; !ok {
+			f.logger.Info("remove record of unknown source", zap.String("source", e.Source), zap.String("name", e.Name))
+			f.hostsChanged, f.stateChanged = true, true
+			continue
+		}
+		f.records[entryKey(e.Source, e)] = e
+	}
+	f.logger.Info("read heartbeats", zap.String("state", statePath), zap.Int("count", len(entries)))
+	return f, nil
+}
+
+// put stores a record. A known record is updated if its name is spelled
+// differently, otherwise only its heartbeat moves.
+func (f *hostsFile) put(key string, e *entry) backend.Change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous, ok := f.records[key]
+	f.records[key] = e
+	if ok && previous.Name == e.Name {
+		f.refreshed = true
+		return backend.ChangeNone
+	}
+	f.hostsChanged, f.stateChanged = true, true
+	if !ok {
+		return backend.ChangeAdded
+	}
+	return backend.ChangeUpdated
+}
+
+func (f *hostsFile) remove(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.records[key]; !ok {
+		return
+	}
+	delete(f.records, key)
+	f.hostsChanged, f.stateChanged = true, true
+}
+
+// list returns copies of the records of a source.
+func (f *hostsFile) list(source string) []entry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries := []entry{}
+	for _, e := range f.records {
+		if e.Source == source {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+// matching returns the records of a source matching fn ordered by key.
+func (f *hostsFile) matching(source string, fn func(e *entry) bool) []backend.Lease {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return backend.Matching(f.records, func(e *entry) backend.Lease { return e }, func(key string, e *entry) bool {
+		return e.Source == source && fn(e)
+	})
+}
+
+// flush writes the files whose content has changed. The heartbeats that have
+// only moved are written if heartbeats is set, so that the state file is not
+// written on every sync.
+func (f *hostsFile) flush(heartbeats bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.hostsChanged {
+		// the lines are ordered by the name below the domain of the source
+		records := make([]*backend.Record, 0, len(f.records))
+		for _, e := range f.records {
+			r := &backend.Record{Name: e.Name, Address: e.Address}
+			if domain := f.sources[e.Source]; domain != "" {
+				r.Name += "." + domain
+			}
+			records = append(records, r)
+		}
+		backend.SortRecords(records)
+
+		var buf bytes.Buffer
+		fmt.Fprintln(&buf, "# written by dhcpd-coredns, changes are overwritten")
+		for _, r := range records {
+			if f.domain != "" {
+				fmt.Fprintf(&buf, "%v\t%v.%v %v\n", r.Address, r.Name, f.domain, r.Name)
+			} else {
+				fmt.Fprintf(&buf, "%v\t%v\n", r.Address, r.Name)
+			}
+		}
+
+		if err := util.WriteFileAtomic(f.path, buf.Bytes()); err != nil {
+			return err
+		}
+		f.hostsChanged = false
+		f.logger.Debug("wrote hosts file", zap.Int("count", len(records)))
+	}
+
+	if f.stateChanged || heartbeats && f.refreshed {
+		keys := make([]string, 0, len(f.records))
+		for key := range f.records {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		entries := make([]*entry, len(keys))
+		for i, key := range keys {
+			entries[i] = f.records[key]
+		}
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		if err := util.WriteFileAtomic(f.statePath, data); err != nil {
+			return err
+		}
+		f.stateChanged, f.refreshed = false, false
+	}
+	return nil
+}
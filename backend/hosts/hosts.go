@@ -0,0 +1,158 @@
+// Package hosts publishes leases to a file in hosts(5) format, e.g. for the
+// hosts plugin of CoreDNS or the addn-hosts option of dnsmasq.
+package hosts
+
+import (
+	"context"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"go.uber.org/zap"
+)
+
+// hostsBackend publishes the records of a lease source to a hosts file that
+// it shares with the other sources.
+type hostsBackend struct {
+	file         *hostsFile
+	source       string
+	leaseTimeout time.Duration
+	logger       *zap.Logger
+}
+
+var (
+	_ backend.Backend = &hostsBackend{}
+	_ backend.Flusher = &hostsBackend{}
+)
+
+// NewHostsBackend reads the heartbeats of the records that have been written
+// before by the configured lease sources, use ForSource to get the backend of
+// a lease source.
+func NewHostsBackend(cfg *config.Config, logger *zap.Logger) (*hostsBackend, error) {
+	if cfg.Hosts.File == "" {
+		return nil, ErrNoFile
+	}
+
+	statePath := cfg.Hosts.State
+	if statePath == "" {
+		statePath = cfg.Hosts.File + ".state"
+	}
+
+	sources := make(map[string]string, len(cfg.Lease))
+	for _, leaseCfg := range cfg.Lease {
+		sources[leaseCfg.Name] = backend.ZoneDomain(leaseCfg.Zone, cfg.KeyPrefix.Zone)
+	}
+
+	file, err := openHostsFile(cfg.Hosts.File, statePath, cfg.Hosts.Domain, sources, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &hostsBackend{file: file, logger: logger}, nil
+}
+
+// ForSource returns the backend of a lease source, whose records are written
+// below the domain of its zone key prefix.
+func (h *hostsBackend) ForSource(leaseCfg *config.LeaseConfig) *hostsBackend {
+	return &hostsBackend{
+		file:         h.file,
+		source:       leaseCfg.Name,
+		leaseTimeout: leaseCfg.Timeout,
+		logger:       h.logger.With(zap.String("source", leaseCfg.Name)),
+	}
+}
+
+func (h *hostsBackend) key(lease backend.Lease) string {
+	return entryKey(h.source, lease)
+}
+
+func (h *hostsBackend) entry(lease backend.Lease) *entry {
+	return &entry{
+		Source:  h.source,
+		Name:    lease.GetName(),
+		Address: lease.GetAddress(),
+		Expires: backend.Deadline(lease, time.Now(), h.leaseTimeout),
+	}
+}
+
+// Put adds the record of a lease or refreshes its heartbeat. The file is
+// written by the next Flush.
+func (h *hostsBackend) Put(ctx context.Context, lease backend.Lease) error {
+	h.file.put(h.key(lease), h.entry(lease))
+	return nil
+}
+
+// Flush writes the hosts file and the state file if records have changed.
+// Heartbeats that have only moved are written by Cleanup.
+func (h *hostsBackend) Flush(ctx context.Context) error {
+	return h.file.flush(false)
+}
+
+func (h *hostsBackend) Delete(ctx context.Context, lease backend.Lease) error {
+	h.file.remove(h.key(lease))
+	return h.file.flush(false)
+}
+
+// List returns the records of the source ordered by name and address.
+func (h *hostsBackend) List(ctx context.Context) ([]*backend.Record, error) {
+	entries := h.file.list(h.source)
+
+	records := make([]*backend.Record, len(entries))
+	for i, e := range entries {
+		records[i] = &backend.Record{Name: e.Name, Address: e.Address, Expires: e.Expires}
+	}
+	backend.SortRecords(records)
+	return records, nil
+}
+
+func (h *hostsBackend) Get(ctx context.Context, name string) ([]*backend.Record, error) {
+	return backend.GetListed(ctx, h, name)
+}
+
+// Reconcile reports records whose name is spelled differently as updated.
+func (h *hostsBackend) Reconcile(ctx context.Context, leases []backend.Lease) (*backend.Diff, error) {
+	diff, _ := backend.Reconciler{
+		Key: h.key,
+		Put: func(ctx context.Context, lease backend.Lease) (backend.Change, error) {
+			return h.file.put(h.key(lease), h.entry(lease)), nil
+		},
+		Stale: func(desired map[string]struct{}) []backend.Lease {
+			return h.file.matching(h.source, func(e *entry) bool {
+				_, ok := desired[h.key(e)]
+				return !ok
+			})
+		},
+		Delete: func(ctx context.Context, lease backend.Lease) error {
+			h.file.remove(h.key(lease))
+			return nil
+		},
+	}.Reconcile(ctx, leases)
+
+	return diff, h.file.flush(false)
+}
+
+// Cleanup removes the records of the source whose heartbeat has expired and
+// writes the heartbeats.
+func (h *hostsBackend) Cleanup(ctx context.Context) error {
+	now := time.Now()
+	for _, lease := range h.file.matching(h.source, func(e *entry) bool {
+		return now.After(e.Expires)
+	}) {
+		h.logger.Info("remove expired lease", zap.String("name", lease.GetName()))
+		h.file.remove(h.key(lease))
+	}
+	return h.file.flush(true)
+}
+
+// Close writes the changes and heartbeats that have not been written yet.
+func (h *hostsBackend) Close(ctx context.Context) error {
+	return h.file.flush(true)
+}
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrNoFile       = Error("hosts file must be configured")
+	ErrInvalidState = Error("invalid hosts state file")
+)
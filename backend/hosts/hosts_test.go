@@ -0,0 +1,199 @@
+package hosts_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/backend/backendtest"
+	"github.com/heilerich/dhcpd-coredns/backend/hosts"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"inet.af/netaddr"
+)
+
+func newTestConfig(t *testing.T) *config.Config {
+	return &config.Config{
+		Hosts: config.HostsConfig{
+			File:   filepath.Join(t.TempDir(), "hosts"),
+			Domain: "example.com",
+		},
+		Lease: []config.LeaseConfig{{Timeout: time.Minute}},
+	}
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		h, err := hosts.NewHostsBackend(newTestConfig(t), zaptest.NewLogger(t))
+		require.NoError(t, err)
+		return h.ForSource(backendtest.Source("", ""))
+	})
+}
+
+func TestHostsFile(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+
+	h, err := hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	vlan10 := h.ForSource(backendtest.Source("vlan10", ""))
+	vlan20 := h.ForSource(backendtest.Source("vlan20", ""))
+
+	require.NoError(t, vlan10.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, vlan20.Put(ctx, backendtest.NewLease("other", "2001:db8::1")))
+	require.NoError(t, vlan10.Flush(ctx))
+
+	content, err := os.ReadFile(cfg.Hosts.File)
+	require.NoError(t, err)
+	assert.Equal(t, "# written by dhcpd-coredns, changes are overwritten\n"+
+		"10.0.0.1\thost.example.com host\n"+
+		"2001:db8::1\tother.example.com other\n", string(content), "records of all sources are written")
+
+	diff, err := vlan20.Reconcile(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, diff.Deleted, 1)
+
+	content, err = os.ReadFile(cfg.Hosts.File)
+	require.NoError(t, err)
+	assert.Equal(t, "# written by dhcpd-coredns, changes are overwritten\n"+
+		"10.0.0.1\thost.example.com host\n", string(content), "reconcile keeps the records of other sources")
+}
+
+func TestReconcileReportsRenamedRecords(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+
+	h, err := hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	b := h.ForSource(backendtest.Source("", ""))
+
+	diff, err := b.Reconcile(ctx, []backend.Lease{backendtest.NewLease("host", "10.0.0.1")})
+	require.NoError(t, err)
+	assert.Len(t, diff.Added, 1)
+
+	renamed := backendtest.NewLease("Host", "10.0.0.1")
+	diff, err = b.Reconcile(ctx, []backend.Lease{renamed})
+	require.NoError(t, err)
+	assert.Equal(t, []backend.Lease{renamed}, diff.Updated, "record with a differently spelled name is updated")
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Deleted)
+
+	content, err := os.ReadFile(cfg.Hosts.File)
+	require.NoError(t, err)
+	assert.Equal(t, "# written by dhcpd-coredns, changes are overwritten\n"+
+		"10.0.0.1\tHost.example.com Host\n", string(content))
+}
+
+func TestSourceDomains(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+	cfg.KeyPrefix.Zone = "/skydns/com/example/"
+	cfg.Lease = []config.LeaseConfig{
+		{Name: "vlan10", Zone: "/skydns/com/example/vlan10/", Timeout: time.Minute},
+		{Name: "vlan20", Zone: "/skydns/com/example/", Timeout: time.Minute},
+	}
+
+	h, err := hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	vlan10 := h.ForSource(&cfg.Lease[0])
+	vlan20 := h.ForSource(&cfg.Lease[1])
+
+	require.NoError(t, vlan10.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, vlan20.Put(ctx, backendtest.NewLease("host", "10.0.0.2")))
+	require.NoError(t, vlan10.Flush(ctx))
+
+	content, err := os.ReadFile(cfg.Hosts.File)
+	require.NoError(t, err)
+	assert.Equal(t, "# written by dhcpd-coredns, changes are overwritten\n"+
+		"10.0.0.2\thost.example.com host\n"+
+		"10.0.0.1\thost.vlan10.example.com host.vlan10\n", string(content), "leases are named below the domain of the zone of their source")
+}
+
+func TestHeartbeatsSurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+	leaseCfg := backendtest.Source("", "")
+
+	h, err := hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	first := h.ForSource(leaseCfg)
+
+	expired := &backendtest.Lease{Name: "expired", Address: netaddr.MustParseIP("10.0.0.1"), Ends: time.Now().Add(-time.Minute)}
+	require.NoError(t, first.Put(ctx, expired))
+	require.NoError(t, first.Put(ctx, backendtest.NewLease("current", "10.0.0.2")))
+	require.NoError(t, first.Close(ctx))
+
+	h, err = hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	second := h.ForSource(leaseCfg)
+
+	records, err := second.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, records, 2, "records are read from the state file")
+
+	require.NoError(t, second.Cleanup(ctx))
+	_, err = second.Get(ctx, "expired")
+	assert.ErrorIs(t, err, backend.ErrNotFound, "expired record is removed after a restart")
+
+	content, err := os.ReadFile(cfg.Hosts.File)
+	require.NoError(t, err)
+	assert.Equal(t, "# written by dhcpd-coredns, changes are overwritten\n"+
+		"10.0.0.2\tcurrent.example.com current\n", string(content))
+}
+
+func TestHeartbeatsAreWrittenAtCleanup(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+	statePath := cfg.Hosts.File + ".state"
+
+	h, err := hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	b := h.ForSource(backendtest.Source("", ""))
+
+	lease := backendtest.NewLease("host", "10.0.0.1")
+	require.NoError(t, b.Put(ctx, lease))
+	require.NoError(t, b.Flush(ctx))
+	written, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Put(ctx, lease))
+	require.NoError(t, b.Flush(ctx))
+	state, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	assert.Equal(t, string(written), string(state), "refreshed heartbeat is not written by Flush")
+
+	require.NoError(t, b.Cleanup(ctx))
+	state, err = os.ReadFile(statePath)
+	require.NoError(t, err)
+	assert.NotEqual(t, string(written), string(state), "refreshed heartbeat is written by Cleanup")
+}
+
+func TestRecordsOfUnknownSources(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+	cfg.Lease = []config.LeaseConfig{{Name: "vlan10"}, {Name: "vlan20"}}
+
+	h, err := hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	vlan10 := h.ForSource(backendtest.Source("vlan10", ""))
+	vlan20 := h.ForSource(backendtest.Source("vlan20", ""))
+	require.NoError(t, vlan10.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, vlan20.Put(ctx, backendtest.NewLease("other", "10.0.0.2")))
+	require.NoError(t, h.Close(ctx))
+
+	// vlan20 has been renamed
+	cfg.Lease = []config.LeaseConfig{{Name: "vlan10"}, {Name: "lab"}}
+	h, err = hosts.NewHostsBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.NoError(t, h.ForSource(backendtest.Source("vlan10", "")).Flush(ctx))
+
+	content, err := os.ReadFile(cfg.Hosts.File)
+	require.NoError(t, err)
+	assert.Equal(t, "# written by dhcpd-coredns, changes are overwritten\n"+
+		"10.0.0.1\thost.example.com host\n", string(content), "records of unknown sources are removed")
+}
@@ -0,0 +1,172 @@
+// Package memory implements a backend that keeps its records in memory, for
+// tests and dry runs.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"go.uber.org/zap"
+)
+
+// MemoryBackend keeps the records of a lease source in memory.
+type MemoryBackend struct {
+	leaseTimeout time.Duration
+	logger       *zap.Logger
+
+	mu sync.Mutex
+	// now is the clock that decides when records expire
+	now     func() time.Time
+	records map[string]*entry
+}
+
+// entry is a record together with the lease it was written for.
+type entry struct {
+	lease  backend.Lease
+	record backend.Record
+}
+
+var _ backend.Backend = &MemoryBackend{}
+
+// NewMemoryBackend returns an empty backend. Like the heartbeats of the etcd
+// backend, records of leases that never end expire unless they are written
+// again within the lease timeout.
+func NewMemoryBackend(leaseTimeout time.Duration, logger *zap.Logger) *MemoryBackend {
+	return &MemoryBackend{
+		leaseTimeout: leaseTimeout,
+		logger:       logger,
+		now:          time.Now,
+		records:      make(map[string]*entry),
+	}
+}
+
+// SetClock replaces the clock that decides when records expire, so that
+// tests can expire records without waiting.
+func (m *MemoryBackend) SetClock(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+func (m *MemoryBackend) key(lease backend.Lease) string {
+	return fmt.Sprintf("%v/%v", strings.ToLower(lease.GetName()), backend.LeaseID(lease))
+}
+
+func (m *MemoryBackend) Put(ctx context.Context, lease backend.Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(lease)
+	return nil
+}
+
+// put writes the record of a lease. A record is updated if the end of its
+// lease has changed, the deadline of a lease that never ends moves with
+// every put. The caller holds mu.
+func (m *MemoryBackend) put(lease backend.Lease) backend.Change {
+	key := m.key(lease)
+	previous, exists := m.records[key]
+	m.records[key] = &entry{
+		lease: lease,
+		record: backend.Record{
+			Name:    lease.GetName(),
+			Address: lease.GetAddress(),
+			Expires: backend.Deadline(lease, m.now(), m.leaseTimeout),
+		},
+	}
+
+	if !exists {
+		m.logger.Info("add record", zap.String("name", lease.GetName()), zap.String("address", lease.GetAddress().String()))
+		return backend.ChangeAdded
+	}
+	if !previous.lease.GetEnds().Equal(lease.GetEnds()) {
+		m.logger.Info("update record", zap.String("name", lease.GetName()), zap.String("address", lease.GetAddress().String()))
+		return backend.ChangeUpdated
+	}
+	return backend.ChangeNone
+}
+
+func (m *MemoryBackend) Delete(ctx context.Context, lease backend.Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(m.key(lease))
+	return nil
+}
+
+// remove deletes a record if it exists. The caller holds mu.
+func (m *MemoryBackend) remove(key string) {
+	e, ok := m.records[key]
+	if !ok {
+		return
+	}
+	delete(m.records, key)
+	m.logger.Info("remove record", zap.String("name", e.record.Name), zap.String("address", e.record.Address.String()))
+}
+
+// List returns the records ordered by name and address. Expired records are
+// listed until Cleanup removes them.
+func (m *MemoryBackend) List(ctx context.Context) ([]*backend.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := make([]*backend.Record, 0, len(m.records))
+	for _, e := range m.records {
+		record := e.record
+		records = append(records, &record)
+	}
+
+	backend.SortRecords(records)
+	return records, nil
+}
+
+func (m *MemoryBackend) Get(ctx context.Context, name string) ([]*backend.Record, error) {
+	return backend.GetListed(ctx, m, name)
+}
+
+// Reconcile reports records whose lease end has changed as updated.
+func (m *MemoryBackend) Reconcile(ctx context.Context, leases []backend.Lease) (*backend.Diff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return backend.Reconciler{
+		Key: m.key,
+		Put: func(ctx context.Context, lease backend.Lease) (backend.Change, error) {
+			return m.put(lease), nil
+		},
+		Stale: func(desired map[string]struct{}) []backend.Lease {
+			return backend.Matching(m.records, func(e *entry) backend.Lease { return e.lease },
+				func(key string, e *entry) bool {
+					_, ok := desired[key]
+					return !ok
+				})
+		},
+		Delete: func(ctx context.Context, lease backend.Lease) error {
+			m.remove(m.key(lease))
+			return nil
+		},
+	}.Reconcile(ctx, leases)
+}
+
+// Cleanup removes the records that have expired.
+func (m *MemoryBackend) Cleanup(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for key, e := range m.records {
+		if now.After(e.record.Expires) {
+			m.logger.Info("remove expired lease", zap.String("name", e.record.Name))
+			m.remove(key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Close(ctx context.Context) error {
+	return nil
+}
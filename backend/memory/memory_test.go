@@ -0,0 +1,73 @@
+package memory_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/backend/backendtest"
+	"github.com/heilerich/dhcpd-coredns/backend/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"inet.af/netaddr"
+)
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		return memory.NewMemoryBackend(backendtest.LeaseTimeout, zaptest.NewLogger(t))
+	})
+}
+
+func TestHeartbeatExpiry(t *testing.T) {
+	ctx := context.Background()
+	m := memory.NewMemoryBackend(time.Minute, zaptest.NewLogger(t))
+
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	m.SetClock(func() time.Time { return now })
+
+	require.NoError(t, m.Put(ctx, backendtest.NewLease("refreshed", "10.0.0.1")))
+	require.NoError(t, m.Put(ctx, backendtest.NewLease("stale", "10.0.0.2")))
+
+	records, err := m.Get(ctx, "stale")
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute), records[0].Expires, "record expires after the lease timeout")
+
+	now = now.Add(50 * time.Second)
+	require.NoError(t, m.Put(ctx, backendtest.NewLease("refreshed", "10.0.0.1")))
+	require.NoError(t, m.Cleanup(ctx))
+	assert.Len(t, backendtest.List(t, m), 2, "records within the lease timeout are kept")
+
+	now = now.Add(20 * time.Second)
+	require.NoError(t, m.Cleanup(ctx))
+	assert.Equal(t, []string{"refreshed (10.0.0.1)"}, backendtest.List(t, m), "stale record is removed")
+}
+
+func TestReconcileReportsChangedExpiry(t *testing.T) {
+	ctx := context.Background()
+	// the lease timeout is longer than the leases, so that it does not cap
+	// their deadlines
+	m := memory.NewMemoryBackend(24*time.Hour, zaptest.NewLogger(t))
+
+	ends := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	lease := &backendtest.Lease{Name: "host", Address: netaddr.MustParseIP("10.0.0.1"), Ends: ends}
+	diff, err := m.Reconcile(ctx, []backend.Lease{lease, backendtest.NewLease("other", "10.0.0.2")})
+	require.NoError(t, err)
+	assert.Len(t, diff.Added, 2)
+
+	diff, err = m.Reconcile(ctx, []backend.Lease{lease, backendtest.NewLease("other", "10.0.0.2")})
+	require.NoError(t, err)
+	assert.True(t, diff.Empty(), "unchanged leases are not reported, even if they never end")
+
+	renewed := &backendtest.Lease{Name: "host", Address: lease.Address, Ends: ends.Add(time.Hour)}
+	diff, err = m.Reconcile(ctx, []backend.Lease{renewed, backendtest.NewLease("other", "10.0.0.2")})
+	require.NoError(t, err)
+	assert.Equal(t, []backend.Lease{renewed}, diff.Updated, "renewed lease is updated")
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Deleted)
+
+	records, err := m.Get(ctx, "host")
+	require.NoError(t, err)
+	assert.Equal(t, ends.Add(time.Hour), records[0].Expires)
+}
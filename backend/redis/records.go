@@ -0,0 +1,122 @@
+package redis
+
+import (
+	"encoding/json"
+
+	"inet.af/netaddr"
+)
+
+// addressRecord is an A or AAAA record of the redis plugin.
+type addressRecord struct {
+	IP  string `json:"ip"`
+	TTL uint32 `json:"ttl"`
+}
+
+// nameRecords are the records of a name, i.e. the value of its field. Records
+// of other types than A and AAAA are kept as they are.
+type nameRecords struct {
+	a, aaaa []addressRecord
+	other   map[string]json.RawMessage
+}
+
+func parseNameRecords(value string) (*nameRecords, error) {
+	records := &nameRecords{other: make(map[string]json.RawMessage)}
+	if value == "" {
+		return records, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &records.other); err != nil {
+		return nil, err
+	}
+	for rrtype, list := range map[string]*[]addressRecord{"a": &records.a, "aaaa": &records.aaaa} {
+		if raw, ok := records.other[rrtype]; ok {
+			if err := json.Unmarshal(raw, list); err != nil {
+				return nil, err
+			}
+			delete(records.other, rrtype)
+		}
+	}
+	return records, nil
+}
+
+func (n *nameRecords) list(addr netaddr.IP) *[]addressRecord {
+	if addr.Is4() {
+		return &n.a
+	}
+	return &n.aaaa
+}
+
+// add adds an address unless the name has it already and reports whether it
+// has been added.
+func (n *nameRecords) add(addr netaddr.IP, ttl uint32) bool {
+	list := n.list(addr)
+	for _, record := range *list {
+		if record.IP == addr.String() {
+			return false
+		}
+	}
+	*list = append(*list, addressRecord{IP: addr.String(), TTL: ttl})
+	return true
+}
+
+// remove removes an address and reports whether the name has had it.
+func (n *nameRecords) remove(addr netaddr.IP) bool {
+	list := n.list(addr)
+	kept := (*list)[:0]
+	for _, record := range *list {
+		if record.IP != addr.String() {
+			kept = append(kept, record)
+		}
+	}
+	removed := len(kept) != len(*list)
+	*list = kept
+	return removed
+}
+
+// only reports whether the name has no other records than the addresses.
+func (n *nameRecords) only(addresses map[string]bool) bool {
+	if len(n.other) > 0 {
+		return false
+	}
+	for _, list := range [][]addressRecord{n.a, n.aaaa} {
+		for _, record := range list {
+			if !addresses[record.IP] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addresses returns the addresses of the A and AAAA records.
+func (n *nameRecords) addresses() []netaddr.IP {
+	addresses := []netaddr.IP{}
+	for _, list := range [][]addressRecord{n.a, n.aaaa} {
+		for _, record := range list {
+			if addr, err := netaddr.ParseIP(record.IP); err == nil {
+				addresses = append(addresses, addr)
+			}
+		}
+	}
+	return addresses
+}
+
+func (n *nameRecords) empty() bool {
+	return len(n.a) == 0 && len(n.aaaa) == 0 && len(n.other) == 0
+}
+
+func (n *nameRecords) marshal() (string, error) {
+	value := make(map[string]interface{}, len(n.other)+2)
+	for rrtype, raw := range n.other {
+		value[rrtype] = raw
+	}
+	if len(n.a) > 0 {
+		value["a"] = n.a
+	}
+	if len(n.aaaa) > 0 {
+		value["aaaa"] = n.aaaa
+	}
+
+	data, err := json.Marshal(value)
+	return string(data), err
+}
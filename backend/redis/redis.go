@@ -0,0 +1,475 @@
+// Package redis publishes leases to Redis in the layout of the redis plugin
+// of CoreDNS, i.e. a hash per zone with a field per name holding the records
+// of the name as JSON.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/config"
+	goredis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// redisBackend writes the records of leases to the hash of a zone. Instead
+// of heartbeat keys, a field that only holds addresses of the backend expires
+// at the deadline of its records, so that Redis removes the records by itself
+// if the backend stops refreshing them. Fields shared with other records do
+// not expire, Cleanup removes the expired addresses in them. After a restart
+// the records of the fields that expire are restored with the time to live
+// of their field, addresses in shared fields are only known again once their
+// lease is put.
+type redisBackend struct {
+	client *goredis.Client
+	// key is the key of the hash of the zone
+	key string
+	// domain is the domain of the source relative to the zone
+	domain       string
+	keyPrefix    string
+	ttl          uint32
+	leaseTimeout time.Duration
+	logger       *zap.Logger
+	// source is set for backends of ForSource, which leave the connection
+	// to be closed by the backend they have been built from
+	source bool
+
+	mu      sync.Mutex
+	records map[string]*record
+	// restored is set once the records of a previous process have been read
+	// from the fields that expire
+	restored bool
+	// updateMu serializes the updates of fields, so that updates of the same
+	// name by this backend do not conflict and see the records of each
+	// other. It is taken before mu.
+	updateMu sync.Mutex
+	// expiring lists the fields that have an expiry, guarded by updateMu
+	expiring map[string]bool
+}
+
+// record is a record written by the backend. Restored records have been
+// read from a field that a previous process has set to expire, they are left
+// to expire unless their lease is put again, as they may have been written
+// by another source below the same domain.
+type record struct {
+	lease    backend.Lease
+	field    string
+	deadline time.Time
+	restored bool
+}
+
+var _ backend.Backend = &redisBackend{}
+
+const (
+	// maxUpdateAttempts limits the attempts of an update whose field has
+	// been changed by someone else at the same time
+	maxUpdateAttempts = 3
+	// fieldNotFound is the result of HEXPIRE for a field that does not exist
+	fieldNotFound = -2
+)
+
+// NewRedisBackend connects to Redis, use ForSource to get the backend of a
+// lease source.
+func NewRedisBackend(cfg *config.Config, logger *zap.Logger) (*redisBackend, error) {
+	redisCfg := cfg.Redis
+	if redisCfg.Zone == "" {
+		return nil, ErrNoZone
+	}
+
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     redisCfg.Address,
+		Username: redisCfg.Username,
+		Password: redisCfg.Password,
+		DB:       redisCfg.DB,
+	})
+
+	zone := strings.TrimSuffix(strings.ToLower(redisCfg.Zone), ".") + "."
+	key := redisCfg.KeyPrefix + zone + redisCfg.KeySuffix
+	return &redisBackend{
+		client:    client,
+		key:       key,
+		keyPrefix: cfg.KeyPrefix.Zone,
+		ttl:       redisCfg.TTL,
+		logger:    logger.With(zap.String("zone", zone)),
+		records:   make(map[string]*record),
+		expiring:  make(map[string]bool),
+	}, nil
+}
+
+// ForSource returns a backend sharing the connection of r that adds the
+// leases of a source to the fields below its domain.
+func (r *redisBackend) ForSource(leaseCfg *config.LeaseConfig) *redisBackend {
+	return &redisBackend{
+		client:       r.client,
+		key:          r.key,
+		domain:       backend.ZoneDomain(leaseCfg.Zone, r.keyPrefix),
+		keyPrefix:    r.keyPrefix,
+		ttl:          r.ttl,
+		leaseTimeout: leaseCfg.Timeout,
+		logger:       r.logger.With(zap.String("source", leaseCfg.Name)),
+		source:       true,
+		records:      make(map[string]*record),
+		expiring:     make(map[string]bool),
+	}
+}
+
+// field returns the field of the hash holding the records of a lease.
+func (r *redisBackend) field(lease backend.Lease) string {
+	field := strings.ToLower(lease.GetName())
+	if r.domain != "" {
+		field = field + "." + r.domain
+	}
+	return field
+}
+
+func (r *redisBackend) recordKey(lease backend.Lease) string {
+	return fmt.Sprintf("%v/%v", r.field(lease), backend.LeaseID(lease))
+}
+
+// restoredLease is the lease of a record read from a field.
+type restoredLease struct {
+	name    string
+	address netaddr.IP
+}
+
+func (l *restoredLease) GetName() string        { return l.name }
+func (l *restoredLease) GetAddress() netaddr.IP { return l.address }
+
+// GetEnds returns the zero time, only the expiry of the field is known.
+func (l *restoredLease) GetEnds() time.Time { return time.Time{} }
+
+// restore reads the records in the fields below the domain of the source
+// that a previous process has set to expire, unless they have been read
+// already. The deadline of a record is the expiry of its field.
+func (r *redisBackend) restore(ctx context.Context) error {
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.restored {
+		return nil
+	}
+
+	values, err := r.client.HGetAll(ctx, r.key).Result()
+	if err != nil {
+		return err
+	}
+	fields := []string{}
+	for field := range values {
+		if r.domain == "" || strings.HasSuffix(field, "."+r.domain) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		r.restored = true
+		return nil
+	}
+
+	ttls, err := r.client.HTTL(ctx, r.key, fields...).Result()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, field := range fields {
+		if ttls[i] <= 0 {
+			// the field does not expire or has been removed
+			continue
+		}
+		records, err := parseNameRecords(values[field])
+		if err != nil {
+			r.logger.Warn("skipping invalid records", zap.String("field", field), zap.Error(err))
+			continue
+		}
+
+		r.expiring[field] = true
+		deadline := now.Add(time.Duration(ttls[i]) * time.Second)
+		for _, address := range records.addresses() {
+			lease := &restoredLease{name: field, address: address}
+			if r.domain != "" {
+				lease.name = strings.TrimSuffix(field, "."+r.domain)
+			}
+			if key := r.recordKey(lease); r.records[key] == nil {
+				r.records[key] = &record{lease: lease, field: field, deadline: deadline, restored: true}
+			}
+		}
+	}
+
+	r.restored = true
+	r.logger.Info("restored records", zap.Int("count", len(r.records)))
+	return nil
+}
+
+// fieldRecords returns the latest deadline and the addresses of the records
+// of a field except the record with key skip. The deadline is the zero time
+// if there are none. The caller holds mu.
+func (r *redisBackend) fieldRecords(field, skip string) (time.Time, map[string]bool) {
+	var deadline time.Time
+	owned := make(map[string]bool)
+	for key, rec := range r.records {
+		if key == skip || rec.field != field {
+			continue
+		}
+		owned[rec.lease.GetAddress().String()] = true
+		if rec.deadline.After(deadline) {
+			deadline = rec.deadline
+		}
+	}
+	return deadline, owned
+}
+
+// expiry returns the time to live of a field that expires at deadline in
+// whole seconds. Redis removes fields with a time to live of zero right away.
+func expiry(deadline time.Time) time.Duration {
+	ttl := int64(math.Ceil(time.Until(deadline).Seconds()))
+	if ttl < 0 {
+		ttl = 0
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Put adds the address of a lease to the records of its name and moves the
+// expiry of the field to the latest deadline of its records if it only holds
+// addresses of the backend.
+func (r *redisBackend) Put(ctx context.Context, lease backend.Lease) error {
+	_, err := r.put(ctx, lease)
+	return err
+}
+
+// put writes the record of a lease and reports whether it is new.
+func (r *redisBackend) put(ctx context.Context, lease backend.Lease) (backend.Change, error) {
+	if err := r.restore(ctx); err != nil {
+		return backend.ChangeNone, err
+	}
+
+	key, field := r.recordKey(lease), r.field(lease)
+	leaseDeadline := backend.Deadline(lease, time.Now(), r.leaseTimeout)
+
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+
+	r.mu.Lock()
+	_, exists := r.records[key]
+	deadline, owned := r.fieldRecords(field, key)
+	r.mu.Unlock()
+	if leaseDeadline.After(deadline) {
+		deadline = leaseDeadline
+	}
+	owned[lease.GetAddress().String()] = true
+
+	err := r.update(ctx, field, deadline, owned, func(records *nameRecords) bool {
+		return records.add(lease.GetAddress(), r.ttl)
+	})
+	if err != nil {
+		return backend.ChangeNone, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[key] = &record{lease: lease, field: field, deadline: leaseDeadline}
+	if exists {
+		return backend.ChangeNone, nil
+	}
+	return backend.ChangeAdded, nil
+}
+
+// Delete removes the address of a lease from the records of its name.
+func (r *redisBackend) Delete(ctx context.Context, lease backend.Lease) error {
+	if err := r.restore(ctx); err != nil {
+		return err
+	}
+
+	key, field := r.recordKey(lease), r.field(lease)
+
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+
+	r.mu.Lock()
+	deadline, owned := r.fieldRecords(field, key)
+	r.mu.Unlock()
+
+	err := r.update(ctx, field, deadline, owned, func(records *nameRecords) bool {
+		return records.remove(lease.GetAddress())
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.records, key)
+	return nil
+}
+
+// update changes the records of a field, change reports whether it has
+// changed them. The field expires at deadline unless deadline is zero or the
+// field holds other records than the owned addresses, so that Redis never
+// removes records the backend has not written. The field is removed if no
+// records are left. The caller holds updateMu.
+func (r *redisBackend) update(ctx context.Context, field string, deadline time.Time, owned map[string]bool, change func(*nameRecords) bool) error {
+	txn := func(tx *goredis.Tx) error {
+		value, err := tx.HGet(ctx, r.key, field).Result()
+		if err != nil && !errors.Is(err, goredis.Nil) {
+			return err
+		}
+
+		records, err := parseNameRecords(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v: %v", ErrInvalidRecords, field, err)
+		}
+		changed := change(records)
+		expires := !deadline.IsZero() && records.only(owned)
+		if !changed && !expires && !r.expiring[field] {
+			return nil
+		}
+
+		var expire *goredis.IntSliceCmd
+		_, err = tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			if records.empty() {
+				pipe.HDel(ctx, r.key, field)
+				return nil
+			}
+
+			if changed {
+				value, err := records.marshal()
+				if err != nil {
+					return err
+				}
+				pipe.HSet(ctx, r.key, field, value)
+			}
+			if expires {
+				expire = pipe.HExpire(ctx, r.key, expiry(deadline), field)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if expire != nil && expire.Val()[0] == fieldNotFound {
+			// Redis has removed the field since it has been read
+			return goredis.TxFailedErr
+		}
+		if !expires && !records.empty() && r.expiring[field] {
+			// the field holds records of others now, HPERSIST is
+			// idempotent and does not need to be part of the transaction
+			if err := tx.HPersist(ctx, r.key, field).Err(); err != nil {
+				return err
+			}
+		}
+
+		if expires {
+			r.expiring[field] = true
+		} else {
+			delete(r.expiring, field)
+		}
+		return nil
+	}
+
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if err = r.client.Watch(ctx, txn, r.key); !errors.Is(err, goredis.TxFailedErr) {
+			return err
+		}
+		r.logger.Debug("field changed during update, retrying", zap.String("field", field))
+	}
+	return err
+}
+
+// List returns the records written by the backend ordered by name and
+// address.
+func (r *redisBackend) List(ctx context.Context) ([]*backend.Record, error) {
+	if err := r.restore(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := make([]*backend.Record, 0, len(r.records))
+	for _, rec := range r.records {
+		records = append(records, &backend.Record{
+			Name:    rec.lease.GetName(),
+			Address: rec.lease.GetAddress(),
+			Expires: rec.deadline,
+		})
+	}
+
+	backend.SortRecords(records)
+	return records, nil
+}
+
+func (r *redisBackend) Get(ctx context.Context, name string) ([]*backend.Record, error) {
+	return backend.GetListed(ctx, r, name)
+}
+
+// Reconcile keeps the restored records.
+func (r *redisBackend) Reconcile(ctx context.Context, leases []backend.Lease) (*backend.Diff, error) {
+	if err := r.restore(ctx); err != nil {
+		return nil, err
+	}
+
+	return backend.Reconciler{
+		Logger: r.logger.WithOptions(zap.Fields(zap.String("op", "redis.Reconcile"))),
+		Key:    r.recordKey,
+		Put:    r.put,
+		Stale: func(desired map[string]struct{}) []backend.Lease {
+			return r.matching(func(key string, rec *record) bool {
+				_, ok := desired[key]
+				return !ok && !rec.restored
+			})
+		},
+		Delete: r.Delete,
+	}.Reconcile(ctx, leases)
+}
+
+// Cleanup removes the addresses whose deadline has passed. Redis removes the
+// fields whose deadline has passed by itself.
+func (r *redisBackend) Cleanup(ctx context.Context) error {
+	logger := r.logger.WithOptions(zap.Fields(zap.String("op", "redis.Cleanup")))
+
+	if err := r.restore(ctx); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, lease := range r.matching(func(key string, rec *record) bool {
+		return now.After(rec.deadline)
+	}) {
+		logger.Info("remove expired lease", zap.String("name", lease.GetName()))
+		if err := r.Delete(ctx, lease); err != nil {
+			logger.Warn("failed to delete record", zap.String("name", lease.GetName()), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// matching returns the leases of the records matching fn ordered by key.
+func (r *redisBackend) matching(fn func(key string, rec *record) bool) []backend.Lease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return backend.Matching(r.records, func(rec *record) backend.Lease { return rec.lease }, fn)
+}
+
+// Close closes the connection unless the backend is the backend of a source.
+func (r *redisBackend) Close(ctx context.Context) error {
+	if r.source {
+		return nil
+	}
+	return r.client.Close()
+}
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrNoZone         = Error("redis zone must be configured")
+	ErrInvalidRecords = Error("invalid records in redis")
+)
@@ -0,0 +1,305 @@
+package redis_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/backend/backendtest"
+	"github.com/heilerich/dhcpd-coredns/backend/redis"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"inet.af/netaddr"
+)
+
+func newTestBackend(t *testing.T, server *testServer, leaseCfg *config.LeaseConfig) backend.Backend {
+	cfg := &config.Config{
+		KeyPrefix: config.PrefixConfig{Zone: "/skydns/com/example/"},
+		Redis: config.RedisConfig{
+			Address:   server.Addr(),
+			Zone:      "example.com",
+			KeyPrefix: "dns:",
+			TTL:       60,
+		},
+	}
+
+	r, err := redis.NewRedisBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, r.Close(context.Background())) })
+	return r.ForSource(leaseCfg)
+}
+
+// testServer is a miniredis server that implements HTTL and HPERSIST, which
+// miniredis lacks, for the fields of a single hash. It records the fields
+// HPERSIST is sent for, the fields keep their expiry in miniredis.
+type testServer struct {
+	*miniredis.Miniredis
+
+	mu        sync.Mutex
+	ttls      map[string]time.Duration
+	persisted []string
+}
+
+func runServer(t *testing.T) *testServer {
+	s := &testServer{Miniredis: miniredis.RunT(t), ttls: make(map[string]time.Duration)}
+
+	s.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch cmd {
+		case "HEXPIRE":
+			// HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field ...
+			seconds, err := strconv.Atoi(args[1])
+			require.NoError(t, err)
+			for _, field := range fields(args) {
+				s.ttls[field] = time.Duration(seconds) * time.Second
+			}
+		case "HDEL":
+			for _, field := range args[1:] {
+				delete(s.ttls, field)
+			}
+		}
+		return false
+	})
+	require.NoError(t, s.Server().Register("HTTL", func(c *server.Peer, cmd string, args []string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		fields := fields(args)
+		c.WriteLen(len(fields))
+		for _, field := range fields {
+			ttl, ok := s.ttls[field]
+			switch {
+			case s.Miniredis.HGet(args[0], field) == "":
+				c.WriteInt(-2)
+			case !ok:
+				c.WriteInt(-1)
+			default:
+				c.WriteInt(int(ttl.Seconds()))
+			}
+		}
+	}))
+	require.NoError(t, s.Server().Register("HPERSIST", func(c *server.Peer, cmd string, args []string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		fields := fields(args)
+		s.persisted = append(s.persisted, fields...)
+		c.WriteLen(len(fields))
+		for _, field := range fields {
+			delete(s.ttls, field)
+			c.WriteInt(1)
+		}
+	}))
+	return s
+}
+
+// fields returns the fields of a hash field command.
+func fields(args []string) []string {
+	for i, arg := range args {
+		if strings.EqualFold(arg, "FIELDS") {
+			return args[i+2:]
+		}
+	}
+	return nil
+}
+
+// FastForward moves the time of the server and of the field expiries.
+func (s *testServer) FastForward(d time.Duration) {
+	s.Miniredis.FastForward(d)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for field, ttl := range s.ttls {
+		if ttl <= d {
+			delete(s.ttls, field)
+		} else {
+			s.ttls[field] = ttl - d
+		}
+	}
+}
+
+func (s *testServer) Persisted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.persisted...)
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		return newTestBackend(t, runServer(t), backendtest.Source("", "/skydns/com/example/"))
+	})
+}
+
+func TestHashLayout(t *testing.T) {
+	ctx := context.Background()
+	server := runServer(t)
+	b := newTestBackend(t, server, backendtest.Source("", "/skydns/com/example/vlan10/"))
+	defer b.Close(ctx)
+
+	server.HSet("dns:example.com.", "host.vlan10", `{"txt":[{"text":"static","ttl":300}]}`)
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "2001:db8::1")))
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("other", "10.0.0.2")))
+
+	assert.JSONEq(t, `{
+		"a": [{"ip": "10.0.0.1", "ttl": 60}],
+		"aaaa": [{"ip": "2001:db8::1", "ttl": 60}],
+		"txt": [{"text": "static", "ttl": 300}]
+	}`, server.HGet("dns:example.com.", "host.vlan10"), "records are added to the field of the name below the source domain")
+	assert.JSONEq(t, `{"a": [{"ip": "10.0.0.2", "ttl": 60}]}`, server.HGet("dns:example.com.", "other.vlan10"))
+
+	require.NoError(t, b.Delete(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	assert.JSONEq(t, `{
+		"aaaa": [{"ip": "2001:db8::1", "ttl": 60}],
+		"txt": [{"text": "static", "ttl": 300}]
+	}`, server.HGet("dns:example.com.", "host.vlan10"), "other records of the name are kept")
+
+	require.NoError(t, b.Delete(ctx, backendtest.NewLease("other", "10.0.0.2")))
+	fields, err := server.HKeys("dns:example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host.vlan10"}, fields, "field without records is removed")
+}
+
+func TestFieldExpiry(t *testing.T) {
+	ctx := context.Background()
+	server := runServer(t)
+	b := newTestBackend(t, server, backendtest.Source("", "/skydns/com/example/"))
+	defer b.Close(ctx)
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+
+	server.FastForward(30 * time.Second)
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	server.FastForward(45 * time.Second)
+	assert.NotEmpty(t, server.HGet("dns:example.com.", "host"), "refreshed field is kept")
+
+	server.FastForward(time.Minute)
+	assert.Empty(t, server.HGet("dns:example.com.", "host"), "Redis removes fields that are not refreshed")
+}
+
+func TestSharedFieldsDoNotExpire(t *testing.T) {
+	ctx := context.Background()
+	server := runServer(t)
+	b := newTestBackend(t, server, backendtest.Source("", "/skydns/com/example/"))
+	defer b.Close(ctx)
+
+	server.HSet("dns:example.com.", "static", `{"txt":[{"text":"static","ttl":300}]}`)
+	server.HSet("dns:example.com.", "other", `{"a":[{"ip":"10.0.0.9","ttl":60}]}`)
+
+	// the leases of the shared fields have ended, so that Cleanup removes
+	// their addresses
+	ended := time.Now().Add(-time.Minute)
+	require.NoError(t, b.Put(ctx, &backendtest.Lease{Name: "static", Address: netaddr.MustParseIP("10.0.0.1"), Ends: ended}))
+	require.NoError(t, b.Put(ctx, &backendtest.Lease{Name: "other", Address: netaddr.MustParseIP("10.0.0.2"), Ends: ended}))
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.3")))
+
+	server.FastForward(2 * time.Minute)
+	assert.NotEmpty(t, server.HGet("dns:example.com.", "static"), "field with other records is kept")
+	assert.NotEmpty(t, server.HGet("dns:example.com.", "other"), "field with addresses of others is kept")
+	assert.Empty(t, server.HGet("dns:example.com.", "host"))
+
+	require.NoError(t, b.Cleanup(ctx))
+	assert.JSONEq(t, `{"txt": [{"text": "static", "ttl": 300}]}`, server.HGet("dns:example.com.", "static"),
+		"Cleanup removes the expired addresses of shared fields")
+	assert.JSONEq(t, `{"a": [{"ip": "10.0.0.9", "ttl": 60}]}`, server.HGet("dns:example.com.", "other"))
+}
+
+func TestExpiredFieldIsWrittenAgain(t *testing.T) {
+	ctx := context.Background()
+	server := runServer(t)
+	b := newTestBackend(t, server, backendtest.Source("", "/skydns/com/example/"))
+	defer b.Close(ctx)
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	server.FastForward(2 * time.Minute)
+	require.Empty(t, server.HGet("dns:example.com.", "host"))
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	assert.JSONEq(t, `{"a": [{"ip": "10.0.0.1", "ttl": 60}]}`, server.HGet("dns:example.com.", "host"),
+		"field removed by Redis is written by the next put")
+}
+
+func TestRecordsAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	server := runServer(t)
+	leaseCfg := backendtest.Source("vlan10", "/skydns/com/example/vlan10/")
+
+	server.HSet("dns:example.com.", "static.vlan10", `{"txt":[{"text":"static","ttl":300}]}`)
+
+	previous := newTestBackend(t, server, leaseCfg)
+	require.NoError(t, previous.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, previous.Put(ctx, backendtest.NewLease("static", "10.0.0.2")))
+	require.NoError(t, previous.Close(ctx))
+	server.FastForward(20 * time.Second)
+
+	other := newTestBackend(t, server, backendtest.Source("other", "/skydns/com/example/other/"))
+	assert.Empty(t, backendtest.List(t, other), "records below the domains of other sources are not restored")
+
+	b := newTestBackend(t, server, leaseCfg)
+	records, err := b.List(ctx)
+	require.NoError(t, err)
+	if assert.Equal(t, []string{"host (10.0.0.1)"}, backendtest.Names(records), "records of fields that expire are restored") {
+		assert.WithinDuration(t, time.Now().Add(40*time.Second), records[0].Expires, time.Second,
+			"restored record expires with its field")
+	}
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.3")))
+	assert.Empty(t, server.Persisted(), "field with restored addresses is not shared with others")
+
+	diff, err := b.Reconcile(ctx, []backend.Lease{backendtest.NewLease("host", "10.0.0.3")})
+	require.NoError(t, err)
+	assert.Empty(t, diff.Deleted, "restored records are left to expire")
+
+	assert.JSONEq(t, `{"a": [{"ip": "10.0.0.1", "ttl": 60}, {"ip": "10.0.0.3", "ttl": 60}]}`,
+		server.HGet("dns:example.com.", "host.vlan10"))
+}
+
+func TestRestoredFieldsArePersisted(t *testing.T) {
+	ctx := context.Background()
+	server := runServer(t)
+	leaseCfg := backendtest.Source("vlan10", "/skydns/com/example/")
+
+	previous := newTestBackend(t, server, leaseCfg)
+	require.NoError(t, previous.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, previous.Close(ctx))
+
+	// someone adds a record to the field that the previous process has set
+	// to expire
+	value := server.HGet("dns:example.com.", "host")
+	server.HSet("dns:example.com.", "host", strings.TrimSuffix(value, "}")+`,"txt":[{"text":"static","ttl":300}]}`)
+
+	b := newTestBackend(t, server, leaseCfg)
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	assert.Equal(t, []string{"host"}, server.Persisted(), "expiry of a shared field written before the restart is removed")
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	assert.Equal(t, []string{"host"}, server.Persisted(), "expiry is only removed once")
+}
+
+func TestConcurrentPutsOwnTheirField(t *testing.T) {
+	ctx := context.Background()
+	server := runServer(t)
+	b := newTestBackend(t, server, backendtest.Source("", "/skydns/com/example/"))
+
+	wg := sync.WaitGroup{}
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, b.Put(ctx, backendtest.NewLease("host", fmt.Sprintf("10.0.0.%d", i))))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Empty(t, server.Persisted(), "field holding only addresses of the backend keeps its expiry")
+	assert.Len(t, backendtest.List(t, b), 20)
+}
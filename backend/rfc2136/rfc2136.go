@@ -0,0 +1,363 @@
+// Package rfc2136 publishes leases to name servers that accept dynamic
+// updates as described in RFC 2136, e.g. BIND or Knot.
+package rfc2136
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// updateBackend adds the records of leases to a zone of a name server. A
+// name server has no place for heartbeats, so the backend keeps the
+// deadlines of the records it has written in its state and only removes
+// those.
+type updateBackend struct {
+	client *dns.Client
+	server string
+	// zone is the fully qualified zone of the forward records
+	zone string
+	// keyPrefix is the zone key prefix that the zones of the sources are
+	// relative to, zonePrefix is the zone key prefix of the source
+	keyPrefix    string
+	zonePrefix   string
+	reverseZones []netaddr.IPPrefix
+	ttl          uint32
+	tsigName     string
+	tsigAlgo     string
+	// source is the name of the lease source the records are written for
+	source       string
+	leaseTimeout time.Duration
+	logger       *zap.Logger
+	// resend is the interval at which Cleanup sends the records again,
+	// resent is when it has last done so
+	resend time.Duration
+	resent time.Time
+
+	// state is shared by the backend and the backends of its sources
+	state *state
+}
+
+var (
+	_ backend.Backend = &updateBackend{}
+	_ backend.Flusher = &updateBackend{}
+)
+
+// tsigFudge is the allowed clock skew between the backend and the server in
+// seconds.
+const tsigFudge = 300
+
+// NewUpdateBackend returns a backend sending updates to the configured name
+// server, use ForSource to get the backend of a lease source.
+func NewUpdateBackend(cfg *config.Config, logger *zap.Logger) (*updateBackend, error) {
+	rfcCfg := cfg.RFC2136
+	if rfcCfg.Server == "" || rfcCfg.Zone == "" {
+		return nil, ErrNoServer
+	}
+
+	reverseZones := make([]netaddr.IPPrefix, len(cfg.Reverse.Zones))
+	for i, zone := range cfg.Reverse.Zones {
+		prefix, err := netaddr.ParseIPPrefix(zone)
+		if err != nil {
+			return nil, err
+		}
+		reverseZones[i] = prefix
+	}
+
+	state, err := openState(rfcCfg.State, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &updateBackend{
+		client:       &dns.Client{Net: rfcCfg.Net, Timeout: rfcCfg.Timeout},
+		server:       rfcCfg.Server,
+		zone:         dns.CanonicalName(rfcCfg.Zone),
+		keyPrefix:    cfg.KeyPrefix.Zone,
+		zonePrefix:   cfg.KeyPrefix.Zone,
+		reverseZones: reverseZones,
+		ttl:          rfcCfg.TTL,
+		logger:       logger,
+		resend:       rfcCfg.Resend,
+		state:        state,
+	}
+
+	if rfcCfg.TSIG.Name != "" {
+		u.tsigName = dns.CanonicalName(rfcCfg.TSIG.Name)
+		u.tsigAlgo = dns.HmacSHA256
+		if rfcCfg.TSIG.Algorithm != "" {
+			u.tsigAlgo = dns.CanonicalName(rfcCfg.TSIG.Algorithm)
+		}
+		u.client.TsigSecret = map[string]string{u.tsigName: rfcCfg.TSIG.Secret}
+	}
+	return u, nil
+}
+
+// ForSource returns a backend sharing the settings and state of u that adds
+// the leases of a source below the domain of its zone key prefix.
+func (u *updateBackend) ForSource(leaseCfg *config.LeaseConfig) *updateBackend {
+	return &updateBackend{
+		client:       u.client,
+		server:       u.server,
+		zone:         u.zone,
+		keyPrefix:    u.keyPrefix,
+		zonePrefix:   leaseCfg.Zone,
+		reverseZones: u.reverseZones,
+		ttl:          u.ttl,
+		tsigName:     u.tsigName,
+		tsigAlgo:     u.tsigAlgo,
+		source:       leaseCfg.Name,
+		leaseTimeout: leaseCfg.Timeout,
+		logger:       u.logger.With(zap.String("source", leaseCfg.Name)),
+		resend:       u.resend,
+		resent:       time.Now(),
+		state:        u.state,
+	}
+}
+
+func (u *updateBackend) fqdn(lease backend.Lease) string {
+	return dns.CanonicalName(backend.RecordName(lease, u.zonePrefix, u.keyPrefix) + "." + u.zone)
+}
+
+func (u *updateBackend) key(lease backend.Lease) string {
+	return recordKey(u.source, lease)
+}
+
+// addressRR returns the A or AAAA record of a lease.
+func (u *updateBackend) addressRR(lease backend.Lease) dns.RR {
+	addr := lease.GetAddress()
+	if addr.Is4() {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: u.fqdn(lease), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: u.ttl},
+			A:   addr.IPAddr().IP,
+		}
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: u.fqdn(lease), Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: u.ttl},
+		AAAA: addr.IPAddr().IP,
+	}
+}
+
+// ptrRR returns the PTR record of a lease and its zone. It returns false if
+// the address is outside the reverse zones.
+func (u *updateBackend) ptrRR(lease backend.Lease) (dns.RR, string, bool) {
+	addr := lease.GetAddress()
+	for _, prefix := range u.reverseZones {
+		if !prefix.Contains(addr) {
+			continue
+		}
+
+		name, err := dns.ReverseAddr(addr.String())
+		if err != nil {
+			return nil, "", false
+		}
+		return &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: u.ttl},
+			Ptr: u.fqdn(lease),
+		}, backend.ReverseZone(prefix), true
+	}
+	return nil, "", false
+}
+
+// Put adds the address record of a lease and replaces its PTR record. If the
+// backend has written the records before only their deadline is refreshed.
+func (u *updateBackend) Put(ctx context.Context, lease backend.Lease) error {
+	_, err := u.put(ctx, lease)
+	return err
+}
+
+// put writes the records of a lease unless they have been written
+// completely before. Records that are known but not synced, e.g. because
+// their PTR update failed, are sent again and reported as updated. The
+// record is kept before its PTR record is written, so that it is removed
+// even if that fails.
+func (u *updateBackend) put(ctx context.Context, lease backend.Lease) (backend.Change, error) {
+	key := u.key(lease)
+	deadline := backend.Deadline(lease, time.Now(), u.leaseTimeout)
+
+	known, synced := u.state.refresh(key, deadline)
+	if known && synced {
+		return backend.ChangeNone, nil
+	}
+
+	change := backend.ChangeUpdated
+	if !known {
+		change = backend.ChangeAdded
+	}
+
+	if err := u.sendAddress(ctx, lease); err != nil {
+		return backend.ChangeNone, err
+	}
+
+	if !known {
+		u.state.add(key, &record{Source: u.source, Name: lease.GetName(), Address: lease.GetAddress(), Expires: deadline})
+	}
+
+	if err := u.sendPTR(ctx, lease, true); err != nil {
+		return change, err
+	}
+
+	u.state.markSynced(key)
+	return change, nil
+}
+
+// sendAddress adds the address record of a lease.
+func (u *updateBackend) sendAddress(ctx context.Context, lease backend.Lease) error {
+	update := new(dns.Msg).SetUpdate(u.zone)
+	update.Insert([]dns.RR{u.addressRR(lease)})
+	return u.exchange(ctx, update)
+}
+
+// sendPTR adds the PTR record of a lease if its address is in one of the
+// reverse zones. If replace is set the other PTR records of the address,
+// e.g. those of a previous lease, are removed.
+func (u *updateBackend) sendPTR(ctx context.Context, lease backend.Lease, replace bool) error {
+	ptr, zone, ok := u.ptrRR(lease)
+	if !ok {
+		return nil
+	}
+
+	update := new(dns.Msg).SetUpdate(zone)
+	if replace {
+		update.RemoveRRset([]dns.RR{ptr})
+	}
+	update.Insert([]dns.RR{ptr})
+	return u.exchange(ctx, update)
+}
+
+// Delete removes the address and PTR record of a lease. The state is saved
+// by the next Flush.
+func (u *updateBackend) Delete(ctx context.Context, lease backend.Lease) error {
+	update := new(dns.Msg).SetUpdate(u.zone)
+	update.Remove([]dns.RR{u.addressRR(lease)})
+	if err := u.exchange(ctx, update); err != nil {
+		return err
+	}
+
+	if ptr, zone, ok := u.ptrRR(lease); ok {
+		update := new(dns.Msg).SetUpdate(zone)
+		update.Remove([]dns.RR{ptr})
+		if err := u.exchange(ctx, update); err != nil {
+			return err
+		}
+	}
+
+	u.state.remove(u.key(lease))
+	return nil
+}
+
+// exchange signs and sends an update and checks that the server has applied
+// it.
+func (u *updateBackend) exchange(ctx context.Context, update *dns.Msg) error {
+	if u.tsigName != "" {
+		update.SetTsig(u.tsigName, u.tsigAlgo, tsigFudge, time.Now().Unix())
+	}
+
+	resp, _, err := u.client.ExchangeContext(ctx, update, u.server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%w: %v", ErrUpdateFailed, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// List returns the records written by the backend ordered by name and
+// address.
+func (u *updateBackend) List(ctx context.Context) ([]*backend.Record, error) {
+	owned := u.state.list(u.source)
+	records := make([]*backend.Record, 0, len(owned))
+	for _, r := range owned {
+		records = append(records, &backend.Record{Name: r.Name, Address: r.Address, Expires: r.Expires})
+	}
+
+	backend.SortRecords(records)
+	return records, nil
+}
+
+func (u *updateBackend) Get(ctx context.Context, name string) ([]*backend.Record, error) {
+	return backend.GetListed(ctx, u, name)
+}
+
+// Reconcile only sends the records of leases that are not synced.
+func (u *updateBackend) Reconcile(ctx context.Context, leases []backend.Lease) (*backend.Diff, error) {
+	diff, err := backend.Reconciler{
+		Logger: u.logger.WithOptions(zap.Fields(zap.String("op", "rfc2136.Reconcile"))),
+		Key:    u.key,
+		Put:    u.put,
+		Stale: func(desired map[string]struct{}) []backend.Lease {
+			return u.state.matching(u.source, func(r *record) bool {
+				_, ok := desired[u.key(r)]
+				return !ok
+			})
+		},
+		Delete: u.Delete,
+	}.Reconcile(ctx, leases)
+
+	if flushErr := u.state.flush(false); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	return diff, err
+}
+
+// Cleanup removes the records whose deadline has passed and saves the
+// deadlines of the others. If a resend interval is configured and it has
+// passed, the others are sent again. Their PTR records are only added, so
+// that this does not replace the PTR records written by others.
+func (u *updateBackend) Cleanup(ctx context.Context) error {
+	logger := u.logger.WithOptions(zap.Fields(zap.String("op", "rfc2136.Cleanup")))
+
+	now := time.Now()
+	for _, lease := range u.state.matching(u.source, func(r *record) bool {
+		return now.After(r.Expires)
+	}) {
+		logger.Info("remove expired lease", zap.String("name", lease.GetName()))
+		if err := u.Delete(ctx, lease); err != nil {
+			logger.Warn("failed to delete record", zap.String("name", lease.GetName()), zap.Error(err))
+		}
+	}
+
+	if u.resend > 0 && now.Sub(u.resent) >= u.resend {
+		u.resent = now
+		for _, lease := range u.state.matching(u.source, func(r *record) bool {
+			return !now.After(r.Expires)
+		}) {
+			err := u.sendAddress(ctx, lease)
+			if err == nil {
+				err = u.sendPTR(ctx, lease, false)
+			}
+			if err != nil {
+				logger.Warn("failed to send record again", zap.String("name", lease.GetName()), zap.Error(err))
+			}
+		}
+	}
+	return u.state.flush(true)
+}
+
+// Flush saves the records that have been added or removed since the last
+// Flush.
+func (u *updateBackend) Flush(ctx context.Context) error {
+	return u.state.flush(false)
+}
+
+// Close saves the deadlines of the records.
+func (u *updateBackend) Close(ctx context.Context) error {
+	return u.state.flush(true)
+}
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrNoServer     = Error("name server and zone must be configured")
+	ErrUpdateFailed = Error("name server rejected update")
+	ErrInvalidState = Error("invalid rfc2136 state file")
+)
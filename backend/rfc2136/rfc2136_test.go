@@ -0,0 +1,216 @@
+package rfc2136_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/backend/backendtest"
+	"github.com/heilerich/dhcpd-coredns/backend/rfc2136"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+const testSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM="
+
+func newTestBackend(t *testing.T, server *nameServer, secret string) backend.Backend {
+	return newStateBackend(t, server, secret, "")
+}
+
+// newStateBackend returns a backend that keeps its records in the state
+// file, or in memory if it is empty.
+func newStateBackend(t *testing.T, server *nameServer, secret, state string) backend.Backend {
+	cfg := testConfig(server, secret, state)
+	u, err := rfc2136.NewUpdateBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	return u.ForSource(backendtest.Source("", cfg.KeyPrefix.Zone))
+}
+
+func testConfig(server *nameServer, secret, state string) *config.Config {
+	return &config.Config{
+		KeyPrefix: config.PrefixConfig{Zone: "/skydns/com/example/"},
+		RFC2136: config.RFC2136Config{
+			Server:  server.addr,
+			Zone:    "example.com",
+			Net:     "udp",
+			Timeout: time.Second,
+			TTL:     60,
+			TSIG:    config.TSIGConfig{Name: "update.", Secret: secret},
+			State:   state,
+		},
+		Reverse: config.ReverseConfig{Zones: []string{"10.0.0.0/8", "2001:db8::/32"}},
+	}
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		server := startNameServer(t, map[string]string{"update.": testSecret})
+		return newTestBackend(t, server, testSecret)
+	})
+}
+
+func TestUpdates(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+	b := newTestBackend(t, server, testSecret)
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "2001:db8::1")))
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("other", "192.168.0.1")))
+
+	assert.Equal(t, []string{
+		"host.example.com. 60 IN A 10.0.0.1",
+		"host.example.com. 60 IN AAAA 2001:db8::1",
+		"other.example.com. 60 IN A 192.168.0.1",
+	}, server.records("example.com."))
+	assert.Equal(t, []string{"1.0.0.10.in-addr.arpa. 60 IN PTR host.example.com."}, server.records("10.in-addr.arpa."),
+		"PTR records are only added to the reverse zones")
+	assert.Len(t, server.records("8.b.d.0.1.0.0.2.ip6.arpa."), 1)
+
+	require.NoError(t, b.Delete(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	assert.Equal(t, []string{
+		"host.example.com. 60 IN AAAA 2001:db8::1",
+		"other.example.com. 60 IN A 192.168.0.1",
+	}, server.records("example.com."))
+	assert.Empty(t, server.records("10.in-addr.arpa."))
+}
+
+func TestSourceZones(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+	u, err := rfc2136.NewUpdateBackend(testConfig(server, testSecret, ""), zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	b := u.ForSource(backendtest.Source("vlan10", "/skydns/com/example/vlan10/"))
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	assert.Equal(t, []string{"host.vlan10.example.com. 60 IN A 10.0.0.1"}, server.records("example.com."),
+		"leases are added below the domain of the zone of the source")
+	assert.Equal(t, []string{"1.0.0.10.in-addr.arpa. 60 IN PTR host.vlan10.example.com."}, server.records("10.in-addr.arpa."))
+}
+
+func TestUnsignedUpdate(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+
+	b := newTestBackend(t, server, "d3Jvbmcta2V5")
+	assert.ErrorIs(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")), rfc2136.ErrUpdateFailed)
+
+	records, err := b.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, records, "rejected record is not listed")
+	assert.Empty(t, server.records("example.com."))
+}
+
+func TestFailedPTRUpdate(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+	b := newTestBackend(t, server, testSecret)
+
+	server.refuse("10.in-addr.arpa.", true)
+	assert.ErrorIs(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")), rfc2136.ErrUpdateFailed)
+	assert.Equal(t, []string{"host (10.0.0.1)"}, backendtest.List(t, b), "address record is kept although its PTR record failed")
+
+	server.refuse("10.in-addr.arpa.", false)
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	assert.Equal(t, []string{"1.0.0.10.in-addr.arpa. 60 IN PTR host.example.com."}, server.records("10.in-addr.arpa."),
+		"PTR record is written by the next put")
+
+	_, err := b.Reconcile(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, server.records("example.com."))
+	assert.Empty(t, server.records("10.in-addr.arpa."))
+}
+
+func TestReconcileSkipsSyncedRecords(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+	b := newTestBackend(t, server, testSecret)
+
+	lease := backendtest.NewLease("host", "10.0.0.1")
+	require.NoError(t, b.Put(ctx, lease))
+
+	server.clear("example.com.")
+	require.NoError(t, b.Put(ctx, lease))
+	assert.Empty(t, server.records("example.com."), "put only refreshes known records")
+
+	diff, err := b.Reconcile(ctx, []backend.Lease{lease})
+	require.NoError(t, err)
+	assert.True(t, diff.Empty())
+	assert.Empty(t, server.records("example.com."), "reconcile does not send synced records again")
+}
+
+func TestCleanupResendsRecords(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+	cfg := testConfig(server, testSecret, "")
+	cfg.RFC2136.Resend = time.Nanosecond
+	u, err := rfc2136.NewUpdateBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	b := u.ForSource(backendtest.Source("", cfg.KeyPrefix.Zone))
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+
+	server.clear("example.com.")
+	server.apply("10.in-addr.arpa.", []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: "1.0.0.10.in-addr.arpa.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+		Ptr: "alias.example.com.",
+	}})
+	require.NoError(t, b.Cleanup(ctx))
+	assert.Equal(t, []string{"host.example.com. 60 IN A 10.0.0.1"}, server.records("example.com."),
+		"cleanup writes the records again")
+	assert.Equal(t, []string{
+		"1.0.0.10.in-addr.arpa. 60 IN PTR alias.example.com.",
+		"1.0.0.10.in-addr.arpa. 60 IN PTR host.example.com.",
+	}, server.records("10.in-addr.arpa."), "PTR records are only added again")
+}
+
+func TestCleanupWithoutResend(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+	b := newTestBackend(t, server, testSecret)
+
+	require.NoError(t, b.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+
+	server.clear("example.com.")
+	require.NoError(t, b.Cleanup(ctx))
+	assert.Empty(t, server.records("example.com."), "records are not sent again by default")
+	assert.Equal(t, []string{"host (10.0.0.1)"}, backendtest.List(t, b))
+}
+
+func TestStateAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	server := startNameServer(t, map[string]string{"update.": testSecret})
+	state := filepath.Join(t.TempDir(), "rfc2136.state")
+
+	previous := newStateBackend(t, server, testSecret, state)
+	require.NoError(t, previous.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, previous.Put(ctx, backendtest.NewLease("other", "10.0.0.2")))
+	require.NoError(t, previous.(backend.Flusher).Flush(ctx))
+
+	b := newStateBackend(t, server, testSecret, state)
+	records, err := b.List(ctx)
+	require.NoError(t, err)
+	if assert.Len(t, records, 2, "records of the previous process are known") {
+		assert.WithinDuration(t, time.Now().Add(time.Minute), records[0].Expires, time.Second)
+	}
+
+	diff, err := b.Reconcile(ctx, []backend.Lease{backendtest.NewLease("host", "10.0.0.1")})
+	require.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	if assert.Len(t, diff.Updated, 1, "records of the previous process are written again") {
+		assert.Equal(t, "host", diff.Updated[0].GetName())
+	}
+	if assert.Len(t, diff.Deleted, 1) {
+		assert.Equal(t, "other", diff.Deleted[0].GetName())
+	}
+	assert.Equal(t, []string{"host.example.com. 60 IN A 10.0.0.1"}, server.records("example.com."),
+		"record of the previous process is removed")
+
+	b = newStateBackend(t, server, testSecret, state)
+	assert.Equal(t, []string{"host (10.0.0.1)"}, backendtest.List(t, b), "removed record is forgotten")
+}
@@ -0,0 +1,144 @@
+package rfc2136_test
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// nameServer is a name server that applies the updates it receives to
+// in-memory zones.
+type nameServer struct {
+	addr        string
+	requireTsig bool
+
+	mu    sync.Mutex
+	zones map[string]map[string]dns.RR
+	// refused lists the zones whose updates are refused
+	refused map[string]bool
+}
+
+// startNameServer starts a name server that only accepts updates signed
+// with one of secrets unless it is empty.
+func startNameServer(t *testing.T, secrets map[string]string) *nameServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &nameServer{
+		addr:        conn.LocalAddr().String(),
+		requireTsig: len(secrets) > 0,
+		zones:       make(map[string]map[string]dns.RR),
+		refused:     make(map[string]bool),
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		Handler:           s,
+		TsigSecret:        secrets,
+		NotifyStartedFunc: func() { close(started) },
+		// the default refuses updates
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return s
+}
+
+func (s *nameServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	resp := new(dns.Msg).SetReply(r)
+
+	tsig := r.IsTsig()
+	switch {
+	case r.Opcode != dns.OpcodeUpdate || len(r.Question) != 1:
+		resp.Rcode = dns.RcodeRefused
+	case tsig == nil && s.requireTsig:
+		resp.Rcode = dns.RcodeRefused
+	case tsig != nil && w.TsigStatus() != nil:
+		resp.Rcode = dns.RcodeNotAuth
+	default:
+		resp.Rcode = s.apply(r.Question[0].Name, r.Ns)
+		if tsig != nil {
+			resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		}
+	}
+	w.WriteMsg(resp)
+}
+
+// apply applies the update section of an update to a zone.
+func (s *nameServer) apply(zone string, updates []dns.RR) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refused[zone] {
+		return dns.RcodeRefused
+	}
+
+	records, ok := s.zones[zone]
+	if !ok {
+		records = make(map[string]dns.RR)
+		s.zones[zone] = records
+	}
+
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			records[rrKey(rr)] = rr
+		case dns.ClassNONE:
+			delete(records, rrKey(rr))
+		case dns.ClassANY:
+			for key, existing := range records {
+				if existing.Header().Name == hdr.Name && (hdr.Rrtype == dns.TypeANY || existing.Header().Rrtype == hdr.Rrtype) {
+					delete(records, key)
+				}
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// rrKey identifies a record by its name, type and data.
+func rrKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Class = dns.ClassINET
+	rr.Header().Ttl = 0
+	return rr.String()
+}
+
+// refuse makes the server refuse the updates of a zone or accept them again.
+func (s *nameServer) refuse(zone string, refused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refused[zone] = refused
+}
+
+// clear removes all records of a zone, as if they had been removed by hand.
+func (s *nameServer) clear(zone string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.zones, zone)
+}
+
+// records returns the records of a zone in presentation format.
+func (s *nameServer) records(zone string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []string{}
+	for _, rr := range s.zones[zone] {
+		records = append(records, strings.ReplaceAll(rr.String(), "\t", " "))
+	}
+	sort.Strings(records)
+	return records
+}
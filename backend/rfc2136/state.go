@@ -0,0 +1,193 @@
+package rfc2136
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/util"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// record is a record written by the backend of a source.
+type record struct {
+	Source  string     `json:"source"`
+	Name    string     `json:"name"`
+	Address netaddr.IP `json:"address"`
+	Expires time.Time  `json:"expires"`
+	// synced is set once the PTR record has been written as well, records
+	// read from the state file are written again by the next Put
+	synced bool
+}
+
+func (r *record) GetName() string        { return r.Name }
+func (r *record) GetAddress() netaddr.IP { return r.Address }
+
+// GetEnds returns the zero time, the state only keeps the deadline.
+func (r *record) GetEnds() time.Time { return time.Time{} }
+
+// recordKey identifies the record of a lease of a source.
+func recordKey(source string, lease backend.Lease) string {
+	return fmt.Sprintf("%v/%v/%v", source, strings.ToLower(lease.GetName()), backend.LeaseID(lease))
+}
+
+// state holds the records written by the backends of all lease sources. A
+// name server has no place for heartbeats, so the records are saved to the
+// state file by the Flush at the end of a sync that has added or removed
+// one and together with their deadlines at Cleanup.
+type state struct {
+	path   string
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	records map[string]*record
+	// dirty is set if records have been added or removed since the state
+	// has been saved
+	dirty bool
+}
+
+// openState reads the state file if it exists.
+func openState(path string, logger *zap.Logger) (*state, error) {
+	s := &state{
+		path:    path,
+		logger:  logger.With(zap.String("state", path)),
+		records: make(map[string]*record),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var records []*record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	for _, r := range records {
+		s.records[recordKey(r.Source, r)] = r
+	}
+	s.logger.Info("read records", zap.Int("count", len(records)))
+	return s, nil
+}
+
+// refresh moves the deadline of a known record. It reports whether the
+// record is known and has been written completely.
+func (s *state) refresh(key string, deadline time.Time) (known, synced bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok {
+		return false, false
+	}
+	r.Expires = deadline
+	return true, r.synced
+}
+
+// add stores a new record.
+func (s *state) add(key string, r *record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = r
+	s.dirty = true
+}
+
+// markSynced notes that all records of a lease have been written.
+func (s *state) markSynced(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok {
+		r.synced = true
+	}
+}
+
+// remove forgets a record.
+func (s *state) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[key]; !ok {
+		return
+	}
+	delete(s.records, key)
+	s.dirty = true
+}
+
+// list returns copies of the records of a source.
+func (s *state) list(source string) []record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []record{}
+	for _, r := range s.records {
+		if r.Source == source {
+			records = append(records, *r)
+		}
+	}
+	return records
+}
+
+// matching returns the records of a source matching fn ordered by key.
+func (s *state) matching(source string, fn func(r *record) bool) []backend.Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return backend.Matching(s.records, func(r *record) backend.Lease { return r }, func(key string, r *record) bool {
+		return r.Source == source && fn(r)
+	})
+}
+
+// flush saves the state if records have been added or removed since it has
+// been saved or, if deadlines is set, to keep the current deadlines.
+func (s *state) flush(deadlines bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty && !deadlines {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the records to the state file. The caller holds mu.
+func (s *state) save() error {
+	if s.path == "" {
+		s.dirty = false
+		return nil
+	}
+
+	keys := make([]string, 0, len(s.records))
+	for key := range s.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]*record, len(keys))
+	for i, key := range keys {
+		records[i] = s.records[key]
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,312 @@
+package zonefile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/util"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// entry is a record of the forward zone together with its heartbeat.
+type entry struct {
+	source string
+	// leaseName is the name of the lease, name is the owner of the record
+	// relative to the origin
+	leaseName, name string
+	address         netaddr.IP
+	deadline        time.Time
+}
+
+func (e *entry) GetName() string        { return e.leaseName }
+func (e *entry) GetAddress() netaddr.IP { return e.address }
+
+// GetEnds returns the zero time, a zone file has no place for lease ends.
+func (e *entry) GetEnds() time.Time { return time.Time{} }
+
+func entryKey(source, name string, address netaddr.IP) string {
+	return fmt.Sprintf("%v/%v/%v", source, strings.ToLower(name), address)
+}
+
+// sourceComment marks the records written by the backend and tells their
+// lease source.
+const sourceComment = "; source="
+
+// reverseZone is the zone of the PTR records of a network.
+type reverseZone struct {
+	path string
+	// origin is fully qualified
+	origin  string
+	network netaddr.IPPrefix
+}
+
+// zone holds the records of all lease sources and writes them to the master
+// files of the forward and reverse zones.
+type zone struct {
+	path string
+	// origin is fully qualified
+	origin      string
+	reverse     []*reverseZone
+	nameServers []string
+	hostmaster  string
+	ttl         uint32
+	logger      *zap.Logger
+
+	mu      sync.Mutex
+	records map[string]*entry
+	serial  uint32
+	// changed tells flush to write the files with the next serial
+	changed bool
+}
+
+// load reads the serial and the records written by the backend from the
+// zone files if they exist. The PTR records are built from the forward
+// records. The records of sources that are not listed in sources are
+// removed.
+func (z *zone) load(sources map[string]struct{}) error {
+	paths := []string{z.path}
+	for _, reverse := range z.reverse {
+		paths = append(paths, reverse.path)
+	}
+	for _, path := range paths {
+		if err := z.loadFile(path); err != nil {
+			return err
+		}
+	}
+
+	for key, e := range z.records {
+		if _, ok := sources[e.source]; !ok {
+			z.logger.Info("remove record of unknown source", zap.String("source", e.source), zap.String("name", e.name))
+			delete(z.records, key)
+			z.changed = true
+		}
+	}
+
+	z.logger.Info("read zone", zap.Uint32("serial", z.serial), zap.Int("count", len(z.records)))
+	return nil
+}
+
+func (z *zone) loadFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	parser := dns.NewZoneParser(f, "", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			if rr.Serial > z.serial {
+				z.serial = rr.Serial
+			}
+		case *dns.A:
+			z.recover(rr.Hdr.Name, rr.A, parser.Comment())
+		case *dns.AAAA:
+			z.recover(rr.Hdr.Name, rr.AAAA, parser.Comment())
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidZoneFile, err)
+	}
+	return nil
+}
+
+// recover adds an address record read from the zone file. Its heartbeat is
+// set when the backend of its source is created.
+func (z *zone) recover(owner string, ip net.IP, comment string) {
+	if !strings.HasPrefix(comment, sourceComment) {
+		return
+	}
+	address, ok := netaddr.FromStdIP(ip)
+	if !ok {
+		return
+	}
+
+	e := &entry{
+		source:  strings.TrimPrefix(comment, sourceComment),
+		name:    strings.TrimSuffix(owner, "."+z.origin),
+		address: address,
+	}
+	z.records[entryKey(e.source, e.name, e.address)] = e
+}
+
+// adopt sets the heartbeats of the records of a source that have been read
+// from the zone file.
+func (z *zone) adopt(source, domain string, deadline time.Time) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for _, e := range z.records {
+		if e.source == source && e.deadline.IsZero() {
+			e.leaseName = strings.TrimSuffix(e.name, "."+domain)
+			e.deadline = deadline
+		}
+	}
+}
+
+// put stores a record and reports whether it is new.
+func (z *zone) put(e *entry) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	key := entryKey(e.source, e.name, e.address)
+	_, ok := z.records[key]
+	z.records[key] = e
+	if !ok {
+		z.changed = true
+	}
+	return !ok
+}
+
+func (z *zone) remove(e *entry) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	key := entryKey(e.source, e.name, e.address)
+	if _, ok := z.records[key]; !ok {
+		return
+	}
+	delete(z.records, key)
+	z.changed = true
+}
+
+// entries returns the records matching fn ordered by key.
+func (z *zone) entries(fn func(e *entry) bool) []*entry {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	keys := []string{}
+	for key, e := range z.records {
+		if fn(e) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	entries := make([]*entry, len(keys))
+	for i, key := range keys {
+		entries[i] = z.records[key]
+	}
+	return entries
+}
+
+// sorted returns the records ordered by their name relative to the origin
+// and address. The caller holds mu.
+func (z *zone) sorted() []*entry {
+	records := make([]*backend.Record, 0, len(z.records))
+	entries := make(map[*backend.Record]*entry, len(z.records))
+	for _, e := range z.records {
+		r := &backend.Record{Name: e.name, Address: e.address}
+		records = append(records, r)
+		entries[r] = e
+	}
+	backend.SortRecords(records)
+
+	sorted := make([]*entry, len(records))
+	for i, r := range records {
+		sorted[i] = entries[r]
+	}
+	return sorted
+}
+
+// flush writes the zone files with the next serial if records have changed.
+// The reverse zones are written first, so that loading the forward zone with
+// the new serial finds its PTR records.
+func (z *zone) flush() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if !z.changed {
+		return nil
+	}
+
+	z.serial++
+	if z.serial == 0 {
+		// serial arithmetic skips zero
+		z.serial = 1
+	}
+	entries := z.sorted()
+
+	for _, reverse := range z.reverse {
+		buf := z.header(reverse.origin)
+		for _, e := range entries {
+			if !reverse.network.Contains(e.address) {
+				continue
+			}
+			name, err := dns.ReverseAddr(e.address.String())
+			if err != nil {
+				return err
+			}
+			writeRR(buf, &dns.PTR{Hdr: z.hdr(name, dns.TypePTR), Ptr: e.name + "." + z.origin}, "")
+		}
+		if err := util.WriteFileAtomic(reverse.path, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	buf := z.header(z.origin)
+	for _, e := range entries {
+		var rr dns.RR
+		if e.address.Is4() {
+			rr = &dns.A{Hdr: z.hdr(e.name+"."+z.origin, dns.TypeA), A: e.address.IPAddr().IP}
+		} else {
+			rr = &dns.AAAA{Hdr: z.hdr(e.name+"."+z.origin, dns.TypeAAAA), AAAA: e.address.IPAddr().IP}
+		}
+		writeRR(buf, rr, sourceComment+e.source)
+	}
+	if err := util.WriteFileAtomic(z.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	z.changed = false
+	z.logger.Debug("wrote zone", zap.Uint32("serial", z.serial), zap.Int("count", len(entries)))
+	return nil
+}
+
+func (z *zone) hdr(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: z.ttl}
+}
+
+// header returns the beginning of a zone file with the SOA and NS records.
+func (z *zone) header(origin string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "; written by dhcpd-coredns, changes are overwritten\n$ORIGIN %v\n$TTL %v\n", origin, z.ttl)
+
+	writeRR(buf, &dns.SOA{
+		Hdr:     z.hdr(origin, dns.TypeSOA),
+		Ns:      z.nameServers[0],
+		Mbox:    z.hostmaster,
+		Serial:  z.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  z.ttl,
+	}, "")
+	for _, ns := range z.nameServers {
+		writeRR(buf, &dns.NS{Hdr: z.hdr(origin, dns.TypeNS), Ns: ns}, "")
+	}
+	return buf
+}
+
+func writeRR(buf *bytes.Buffer, rr dns.RR, comment string) {
+	buf.WriteString(rr.String())
+	if comment != "" {
+		buf.WriteString("\t")
+		buf.WriteString(comment)
+	}
+	buf.WriteString("\n")
+}
@@ -0,0 +1,218 @@
+// Package zonefile publishes leases to master files as described in RFC 1035,
+// e.g. for the file and auto plugins of CoreDNS or BIND.
+package zonefile
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// zoneBackend publishes the records of a lease source to zone files that it
+// shares with the other sources.
+type zoneBackend struct {
+	zone *zone
+	// keyPrefix is the zone key prefix that the zones of the sources are
+	// relative to
+	keyPrefix string
+	source    string
+	// zonePrefix is the zone key prefix of the source, domain is the domain
+	// it stands for
+	zonePrefix   string
+	domain       string
+	leaseTimeout time.Duration
+	logger       *zap.Logger
+}
+
+var (
+	_ backend.Backend = &zoneBackend{}
+	_ backend.Flusher = &zoneBackend{}
+)
+
+// NewZoneBackend reads the records that have been written to the zone files
+// before by the configured lease sources, use ForSource to get the backend of
+// a lease source.
+func NewZoneBackend(cfg *config.Config, logger *zap.Logger) (*zoneBackend, error) {
+	zoneCfg := cfg.ZoneFile
+	if zoneCfg.File == "" || zoneCfg.Origin == "" {
+		return nil, ErrNoZone
+	}
+	if len(zoneCfg.NameServers) == 0 {
+		return nil, ErrNoNameServer
+	}
+
+	origin := dns.CanonicalName(zoneCfg.Origin)
+	z := &zone{
+		path:       zoneCfg.File,
+		origin:     origin,
+		hostmaster: "hostmaster." + origin,
+		ttl:        zoneCfg.TTL,
+		logger:     logger.With(zap.String("zone", origin)),
+		records:    make(map[string]*entry),
+	}
+	for _, ns := range zoneCfg.NameServers {
+		z.nameServers = append(z.nameServers, dns.CanonicalName(ns))
+	}
+	if zoneCfg.Hostmaster != "" {
+		z.hostmaster = dns.CanonicalName(zoneCfg.Hostmaster)
+	}
+
+	if zoneCfg.ReverseDir != "" {
+		if len(cfg.Reverse.Zones) == 0 {
+			return nil, ErrReverseZone
+		}
+		for _, network := range cfg.Reverse.Zones {
+			prefix, err := netaddr.ParseIPPrefix(network)
+			if err != nil {
+				return nil, err
+			}
+			origin := backend.ReverseZone(prefix)
+			z.reverse = append(z.reverse, &reverseZone{
+				path:    filepath.Join(zoneCfg.ReverseDir, "db."+strings.TrimSuffix(origin, ".")),
+				origin:  origin,
+				network: prefix,
+			})
+		}
+	}
+
+	sources := make(map[string]struct{}, len(cfg.Lease))
+	for _, leaseCfg := range cfg.Lease {
+		sources[leaseCfg.Name] = struct{}{}
+	}
+	if err := z.load(sources); err != nil {
+		return nil, err
+	}
+	return &zoneBackend{zone: z, keyPrefix: cfg.KeyPrefix.Zone, logger: logger}, nil
+}
+
+// ForSource returns the backend of a lease source and adopts its records
+// read from the zone files.
+func (b *zoneBackend) ForSource(leaseCfg *config.LeaseConfig) *zoneBackend {
+	source := &zoneBackend{
+		zone:         b.zone,
+		keyPrefix:    b.keyPrefix,
+		source:       leaseCfg.Name,
+		zonePrefix:   leaseCfg.Zone,
+		domain:       backend.ZoneDomain(leaseCfg.Zone, b.keyPrefix),
+		leaseTimeout: leaseCfg.Timeout,
+		logger:       b.logger.With(zap.String("source", leaseCfg.Name)),
+	}
+
+	// records read from the zone files expire unless they are refreshed
+	// within the lease timeout
+	b.zone.adopt(source.source, source.domain, time.Now().UTC().Add(source.leaseTimeout))
+	return source
+}
+
+func (b *zoneBackend) entry(lease backend.Lease) *entry {
+	return &entry{
+		source:    b.source,
+		leaseName: lease.GetName(),
+		name:      backend.RecordName(lease, b.zonePrefix, b.keyPrefix),
+		address:   lease.GetAddress(),
+		deadline:  backend.Deadline(lease, time.Now(), b.leaseTimeout),
+	}
+}
+
+// Put adds the record of a lease or refreshes its heartbeat. The zone files
+// are written by the next Flush.
+func (b *zoneBackend) Put(ctx context.Context, lease backend.Lease) error {
+	b.zone.put(b.entry(lease))
+	return nil
+}
+
+// Flush writes the zone files with a new serial if records have changed.
+func (b *zoneBackend) Flush(ctx context.Context) error {
+	return b.zone.flush()
+}
+
+func (b *zoneBackend) Delete(ctx context.Context, lease backend.Lease) error {
+	b.zone.remove(b.entry(lease))
+	return b.zone.flush()
+}
+
+// List returns the records of the source ordered by name and address.
+func (b *zoneBackend) List(ctx context.Context) ([]*backend.Record, error) {
+	entries := b.zone.entries(func(e *entry) bool { return e.source == b.source })
+
+	records := make([]*backend.Record, len(entries))
+	for i, e := range entries {
+		records[i] = &backend.Record{Name: e.leaseName, Address: e.address, Expires: e.deadline}
+	}
+	backend.SortRecords(records)
+	return records, nil
+}
+
+func (b *zoneBackend) Get(ctx context.Context, name string) ([]*backend.Record, error) {
+	return backend.GetListed(ctx, b, name)
+}
+
+// Reconcile writes the zone files right away if records have changed.
+func (b *zoneBackend) Reconcile(ctx context.Context, leases []backend.Lease) (*backend.Diff, error) {
+	key := func(lease backend.Lease) string {
+		e := b.entry(lease)
+		return entryKey(e.source, e.name, e.address)
+	}
+
+	diff, _ := backend.Reconciler{
+		Key: key,
+		Put: func(ctx context.Context, lease backend.Lease) (backend.Change, error) {
+			if b.zone.put(b.entry(lease)) {
+				return backend.ChangeAdded, nil
+			}
+			return backend.ChangeNone, nil
+		},
+		Stale: func(desired map[string]struct{}) []backend.Lease {
+			stale := b.zone.entries(func(e *entry) bool {
+				_, ok := desired[entryKey(e.source, e.name, e.address)]
+				return e.source == b.source && !ok
+			})
+			leases := make([]backend.Lease, len(stale))
+			for i, e := range stale {
+				leases[i] = e
+			}
+			return leases
+		},
+		Delete: func(ctx context.Context, lease backend.Lease) error {
+			b.zone.remove(b.entry(lease))
+			return nil
+		},
+	}.Reconcile(ctx, leases)
+
+	return diff, b.zone.flush()
+}
+
+// Cleanup removes the records of the source whose heartbeat has expired.
+func (b *zoneBackend) Cleanup(ctx context.Context) error {
+	now := time.Now()
+	for _, e := range b.zone.entries(func(e *entry) bool {
+		return e.source == b.source && now.After(e.deadline)
+	}) {
+		b.logger.Info("remove expired lease", zap.String("name", e.leaseName))
+		b.zone.remove(e)
+	}
+	return b.zone.flush()
+}
+
+// Close writes the changes that have not been flushed yet.
+func (b *zoneBackend) Close(ctx context.Context) error {
+	return b.zone.flush()
+}
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrNoZone          = Error("zone file and origin must be configured")
+	ErrNoNameServer    = Error("zone needs a name server")
+	ErrReverseZone     = Error("reverse zone files need reverse zones")
+	ErrInvalidZoneFile = Error("invalid zone file")
+)
@@ -0,0 +1,170 @@
+package zonefile_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/backend/backendtest"
+	"github.com/heilerich/dhcpd-coredns/backend/zonefile"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newTestConfig(t *testing.T) *config.Config {
+	dir := t.TempDir()
+	return &config.Config{
+		KeyPrefix: config.PrefixConfig{Zone: "/skydns/com/example/"},
+		Reverse:   config.ReverseConfig{Zones: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		ZoneFile: config.ZoneFileConfig{
+			File:        filepath.Join(dir, "db.example.com"),
+			ReverseDir:  dir,
+			Origin:      "example.com",
+			NameServers: []string{"ns1.example.com"},
+			TTL:         60,
+		},
+	}
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		cfg := newTestConfig(t)
+		z, err := zonefile.NewZoneBackend(cfg, zaptest.NewLogger(t))
+		require.NoError(t, err)
+		return z.ForSource(backendtest.Source("", cfg.KeyPrefix.Zone))
+	})
+}
+
+// readZone parses a zone file and returns its records without the SOA
+// record and the serial of the SOA record.
+func readZone(t *testing.T, path string) ([]string, uint32) {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var serial uint32
+	records := []string{}
+	parser := dns.NewZoneParser(f, "", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if soa, ok := rr.(*dns.SOA); ok {
+			serial = soa.Serial
+			continue
+		}
+		records = append(records, strings.ReplaceAll(rr.String(), "\t", " "))
+	}
+	require.NoError(t, parser.Err())
+	return records, serial
+}
+
+func TestZoneFiles(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+
+	z, err := zonefile.NewZoneBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	vlan10 := z.ForSource(backendtest.Source("vlan10", "/skydns/com/example/vlan10/"))
+	other := z.ForSource(backendtest.Source("other", cfg.KeyPrefix.Zone))
+
+	require.NoError(t, vlan10.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, other.Put(ctx, backendtest.NewLease("other", "2001:db8::1")))
+	require.NoError(t, vlan10.Flush(ctx))
+
+	records, serial := readZone(t, cfg.ZoneFile.File)
+	assert.Equal(t, uint32(1), serial)
+	assert.Equal(t, []string{
+		"example.com. 60 IN NS ns1.example.com.",
+		"host.vlan10.example.com. 60 IN A 10.0.0.1",
+		"other.example.com. 60 IN AAAA 2001:db8::1",
+	}, records, "leases are added below the domain of their zone key prefix")
+
+	records, serial = readZone(t, filepath.Join(cfg.ZoneFile.ReverseDir, "db.10.in-addr.arpa"))
+	assert.Equal(t, uint32(1), serial)
+	assert.Equal(t, []string{
+		"10.in-addr.arpa. 60 IN NS ns1.example.com.",
+		"1.0.0.10.in-addr.arpa. 60 IN PTR host.vlan10.example.com.",
+	}, records)
+
+	records, _ = readZone(t, filepath.Join(cfg.ZoneFile.ReverseDir, "db.8.b.d.0.1.0.0.2.ip6.arpa"))
+	assert.Equal(t, []string{
+		"8.b.d.0.1.0.0.2.ip6.arpa. 60 IN NS ns1.example.com.",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. 60 IN PTR other.example.com.",
+	}, records, "every reverse zone has its own file")
+
+	require.NoError(t, vlan10.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, vlan10.Flush(ctx))
+	_, serial = readZone(t, cfg.ZoneFile.File)
+	assert.Equal(t, uint32(1), serial, "serial is kept if nothing has changed")
+
+	require.NoError(t, vlan10.Delete(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	records, serial = readZone(t, cfg.ZoneFile.File)
+	assert.Equal(t, uint32(2), serial, "serial is bumped on every change")
+	assert.Equal(t, []string{
+		"example.com. 60 IN NS ns1.example.com.",
+		"other.example.com. 60 IN AAAA 2001:db8::1",
+	}, records)
+}
+
+func TestRecordsSurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+	leaseCfg := backendtest.Source("vlan10", "/skydns/com/example/vlan10/")
+	cfg.Lease = []config.LeaseConfig{*leaseCfg}
+
+	z, err := zonefile.NewZoneBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	first := z.ForSource(leaseCfg)
+	require.NoError(t, first.Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, first.Close(ctx))
+
+	z, err = zonefile.NewZoneBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	second := z.ForSource(leaseCfg)
+
+	records, err := second.List(ctx)
+	require.NoError(t, err)
+	if assert.Len(t, records, 1, "records are read from the zone file") {
+		assert.Equal(t, "host (10.0.0.1)", records[0].String())
+		assert.WithinDuration(t, time.Now().Add(time.Minute), records[0].Expires, 5*time.Second,
+			"read records expire after the lease timeout")
+	}
+
+	diff, err := second.Reconcile(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, diff.Deleted, 1)
+
+	_, serial := readZone(t, cfg.ZoneFile.File)
+	assert.Equal(t, uint32(2), serial, "serial continues after a restart")
+}
+
+func TestRecordsOfUnknownSources(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+	vlan10 := backendtest.Source("vlan10", "/skydns/com/example/vlan10/")
+	vlan20 := backendtest.Source("vlan20", "/skydns/com/example/vlan20/")
+	cfg.Lease = []config.LeaseConfig{*vlan10, *vlan20}
+
+	z, err := zonefile.NewZoneBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.NoError(t, z.ForSource(vlan10).Put(ctx, backendtest.NewLease("host", "10.0.0.1")))
+	require.NoError(t, z.ForSource(vlan20).Put(ctx, backendtest.NewLease("other", "10.0.0.2")))
+	require.NoError(t, z.Close(ctx))
+
+	// vlan20 has been renamed
+	cfg.Lease = []config.LeaseConfig{*vlan10, *backendtest.Source("lab", "/skydns/com/example/vlan20/")}
+	z, err = zonefile.NewZoneBackend(cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.NoError(t, z.ForSource(vlan10).Flush(ctx))
+
+	records, _ := readZone(t, cfg.ZoneFile.File)
+	assert.Equal(t, []string{
+		"example.com. 60 IN NS ns1.example.com.",
+		"host.vlan10.example.com. 60 IN A 10.0.0.1",
+	}, records, "records of unknown sources are removed")
+}
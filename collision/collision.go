@@ -0,0 +1,304 @@
+package collision
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	// PolicyAllow publishes the addresses of all clients under the name
+	PolicyAllow = "allow"
+	// PolicyNewest publishes only the client that has claimed the name last
+	PolicyNewest = "newest"
+	// PolicyFirst publishes only the client that has claimed the name first
+	PolicyFirst = "first"
+	// PolicySuffix publishes the first client under the name and the others
+	// under the name suffixed with their hardware or IP address
+	PolicySuffix = "suffix"
+)
+
+const (
+	maxLabelLength = 63
+	maxNameLength  = 253
+)
+
+var conflictsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dhcpd_coredns_name_conflicts_total",
+	Help: "Number of hostnames that have been claimed by several clients.",
+})
+
+type resolver struct {
+	policy string
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// conflicts remembers the clients of every conflicting name, so that a
+	// conflict is logged when it appears and not on every sync
+	conflicts map[string]string
+	// claimed holds when every client has claimed its name, by the start of
+	// its leases when it has been seen first. dhcpd moves the start of a
+	// lease on every renewal, which would reorder the clients.
+	claimed map[string]time.Time
+}
+
+// NewResolver returns a resolver that decides which leases are published
+// if leases of different clients have the same name.
+func NewResolver(policy string, logger *zap.Logger) (*resolver, error) {
+	switch policy {
+	case PolicyAllow, PolicyNewest, PolicyFirst, PolicySuffix:
+	case "":
+		policy = PolicyAllow
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPolicy, policy)
+	}
+	return &resolver{
+		policy:    policy,
+		logger:    logger,
+		conflicts: make(map[string]string),
+		claimed:   make(map[string]time.Time),
+	}, nil
+}
+
+// client holds the leases of a single client with the same name.
+type client struct {
+	id     string
+	leases []*parser.Lease
+	// claimed is when the client has claimed the name
+	claimed time.Time
+}
+
+// Leases returns the leases to publish according to the policy. The passed
+// leases are not modified.
+func (r *resolver) Leases(leases []*parser.Lease) []*parser.Lease {
+	names := []string{}
+	clients := make(map[string][]*client)
+	for _, lease := range leases {
+		name := strings.ToLower(lease.Name)
+		if _, ok := clients[name]; !ok {
+			names = append(names, name)
+		}
+		clients[name] = addLease(clients[name], lease)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.track(clients)
+
+	// taken holds the client of every published name, the names of the
+	// leases themselves are reserved for their clients
+	taken := make(map[string]string, len(names))
+	for _, name := range names {
+		if len(clients[name]) == 1 {
+			taken[name] = clients[name][0].id
+		} else {
+			taken[name] = ""
+		}
+	}
+
+	resolved := make([]*parser.Lease, 0, len(leases))
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		nameClients := clients[name]
+		if len(nameClients) > 1 {
+			seen[name] = struct{}{}
+			r.report(name, nameClients)
+		}
+		resolved = append(resolved, r.resolve(nameClients, taken)...)
+	}
+
+	for name := range r.conflicts {
+		if _, ok := seen[name]; !ok {
+			r.logger.Info("hostname conflict resolved", zap.String("name", name))
+			delete(r.conflicts, name)
+		}
+	}
+	return resolved
+}
+
+func addLease(clients []*client, lease *parser.Lease) []*client {
+	id := clientID(lease)
+	started := startTime(lease)
+	for _, c := range clients {
+		if c.id == id {
+			c.leases = append(c.leases, lease)
+			if started.Before(c.claimed) {
+				c.claimed = started
+			}
+			return clients
+		}
+	}
+	return append(clients, &client{id: id, leases: []*parser.Lease{lease}, claimed: started})
+}
+
+// track sets the claims of the clients that have been seen before and
+// remembers those of new clients. Clients that are gone are forgotten. The
+// caller holds mu.
+func (r *resolver) track(clients map[string][]*client) {
+	seen := make(map[string]struct{})
+	for name, nameClients := range clients {
+		for _, c := range nameClients {
+			key := name + " " + c.id
+			seen[key] = struct{}{}
+			if claimed, ok := r.claimed[key]; ok {
+				c.claimed = claimed
+			} else {
+				r.claimed[key] = c.claimed
+			}
+		}
+	}
+
+	for key := range r.claimed {
+		if _, ok := seen[key]; !ok {
+			delete(r.claimed, key)
+		}
+	}
+}
+
+// clientID identifies the client of a lease by its hardware address, its
+// client identifier or, if it has neither, its address.
+func clientID(lease *parser.Lease) string {
+	switch {
+	case len(lease.Hardware) > 0:
+		return lease.Hardware.String()
+	case lease.UID != "":
+		return fmt.Sprintf("uid %x", lease.UID)
+	}
+	return lease.Address.String()
+}
+
+// startTime returns the start of a lease or the client's last transaction
+// time for formats that do not record the start.
+func startTime(lease *parser.Lease) time.Time {
+	if !lease.Starts.IsZero() {
+		return lease.Starts
+	}
+	return lease.Cltt
+}
+
+func (r *resolver) report(name string, clients []*client) {
+	ids := make([]string, len(clients))
+	for i, c := range clients {
+		ids[i] = c.id
+	}
+	sort.Strings(ids)
+
+	signature := strings.Join(ids, ",")
+	if r.conflicts[name] == signature {
+		return
+	}
+	r.conflicts[name] = signature
+	conflictsTotal.Inc()
+	r.logger.Warn("hostname claimed by several clients", zap.String("name", name),
+		zap.Strings("clients", ids), zap.String("policy", r.policy))
+}
+
+// resolve returns the leases of the clients of a name to publish. Suffixed
+// names are added to taken.
+func (r *resolver) resolve(clients []*client, taken map[string]string) []*parser.Lease {
+	if len(clients) == 1 || r.policy == PolicyAllow {
+		leases := []*parser.Lease{}
+		for _, c := range clients {
+			leases = append(leases, c.leases...)
+		}
+		return leases
+	}
+
+	// order by claim and, for equal claims, by id to stay stable across syncs
+	sort.SliceStable(clients, func(i, j int) bool {
+		if !clients[i].claimed.Equal(clients[j].claimed) {
+			return clients[i].claimed.Before(clients[j].claimed)
+		}
+		return clients[i].id < clients[j].id
+	})
+
+	switch r.policy {
+	case PolicyNewest:
+		return clients[len(clients)-1].leases
+	case PolicyFirst:
+		return clients[0].leases
+	}
+
+	leases := append([]*parser.Lease{}, clients[0].leases...)
+	for _, c := range clients[1:] {
+		leases = append(leases, r.suffixed(c, taken)...)
+	}
+	return leases
+}
+
+// suffixed returns the leases of a client under its suffixed name. The
+// client is left out if the suffixed name is too long or is the name of
+// another client.
+func (r *resolver) suffixed(c *client, taken map[string]string) []*parser.Lease {
+	name := suffixName(strings.ToLower(c.leases[0].Name), suffix(c.leases[0]))
+	if name == "" {
+		r.logger.Warn("hostname too long to add a suffix, not publishing client",
+			zap.String("name", c.leases[0].Name), zap.String("client", c.id))
+		return nil
+	}
+	if owner, ok := taken[name]; ok && owner != c.id {
+		r.logger.Warn("suffixed hostname is claimed by another client, not publishing client",
+			zap.String("name", name), zap.String("client", c.id))
+		return nil
+	}
+	taken[name] = c.id
+
+	leases := make([]*parser.Lease, len(c.leases))
+	for i, lease := range c.leases {
+		suffixed := *lease
+		suffixed.Name = name
+		leases[i] = &suffixed
+	}
+	return leases
+}
+
+// suffix returns the hardware address of the lease without separators or,
+// if it has none, its address.
+func suffix(lease *parser.Lease) string {
+	if len(lease.Hardware) > 0 {
+		return fmt.Sprintf("%x", []byte(lease.Hardware))
+	}
+	return strings.NewReplacer(".", "-", ":", "-").Replace(lease.Address.StringExpanded())
+}
+
+// suffixName appends suffix to the first label of name and shortens the
+// label to keep it and the name within the length limits. It returns an
+// empty string if the rest of the name leaves no room for the suffix.
+func suffixName(name, suffix string) string {
+	labels := strings.SplitN(name, ".", 2)
+
+	max := maxLabelLength
+	if len(labels) > 1 && maxNameLength-len(labels[1])-1 < max {
+		max = maxNameLength - len(labels[1]) - 1
+	}
+	max -= len(suffix) + 1
+
+	label := labels[0]
+	if len(label) > max {
+		if max <= 0 {
+			return ""
+		}
+		label = strings.TrimRight(label[:max], "-")
+	}
+	if label == "" {
+		return ""
+	}
+
+	labels[0] = label + "-" + suffix
+	return strings.Join(labels, ".")
+}
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrUnknownPolicy = Error("unknown hostname collision policy")
+)
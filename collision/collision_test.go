@@ -0,0 +1,162 @@
+package collision_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/collision"
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+	"inet.af/netaddr"
+)
+
+func lease(name, address, mac string, starts time.Time) *parser.Lease {
+	hardware, _ := net.ParseMAC(mac)
+	return &parser.Lease{
+		Name:     name,
+		Address:  netaddr.MustParseIP(address),
+		Hardware: hardware,
+		Starts:   starts,
+	}
+}
+
+func names(leases []*parser.Lease) []string {
+	result := []string{}
+	for _, lease := range leases {
+		result = append(result, lease.String())
+	}
+	return result
+}
+
+func TestCollisionPolicies(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	now := time.Now()
+	leases := []*parser.Lease{
+		lease("laptop", "10.0.0.2", "00:00:00:00:00:02", now),
+		lease("laptop", "10.0.0.1", "00:00:00:00:00:01", now.Add(-time.Hour)),
+		// a second lease of the first client is not a conflict
+		lease("laptop", "10.0.1.1", "00:00:00:00:00:01", now),
+		lease("printer", "10.0.0.3", "00:00:00:00:00:03", now),
+	}
+
+	cases := map[string][]string{
+		collision.PolicyAllow:  {"laptop (10.0.0.2)", "laptop (10.0.0.1)", "laptop (10.0.1.1)", "printer (10.0.0.3)"},
+		collision.PolicyNewest: {"laptop (10.0.0.2)", "printer (10.0.0.3)"},
+		collision.PolicyFirst:  {"laptop (10.0.0.1)", "laptop (10.0.1.1)", "printer (10.0.0.3)"},
+		collision.PolicySuffix: {"laptop (10.0.0.1)", "laptop (10.0.1.1)", "laptop-000000000002 (10.0.0.2)", "printer (10.0.0.3)"},
+	}
+
+	for policy, expected := range cases {
+		resolver, err := collision.NewResolver(policy, logger)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, names(resolver.Leases(leases)), "policy %v", policy)
+		}
+	}
+
+	assert.Equal(t, "laptop (10.0.0.2)", leases[0].String(), "original lease is not modified")
+
+	_, err := collision.NewResolver("random", logger)
+	assert.ErrorIs(t, err, collision.ErrUnknownPolicy)
+}
+
+func TestRenewalKeepsPublishedClient(t *testing.T) {
+	now := time.Now()
+	first := lease("laptop", "10.0.0.1", "00:00:00:00:00:01", now.Add(-time.Hour))
+	second := lease("laptop", "10.0.0.2", "00:00:00:00:00:02", now.Add(-time.Minute))
+
+	resolver, err := collision.NewResolver(collision.PolicyNewest, zaptest.NewLogger(t))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"laptop (10.0.0.2)"}, names(resolver.Leases([]*parser.Lease{first, second})))
+
+	// dhcpd moves the start of a lease on every renewal
+	renewed := lease("laptop", "10.0.0.1", "00:00:00:00:00:01", now)
+	assert.Equal(t, []string{"laptop (10.0.0.2)"}, names(resolver.Leases([]*parser.Lease{renewed, second})),
+		"renewing the other client does not move the name")
+
+	resolver.Leases([]*parser.Lease{second})
+	assert.Equal(t, []string{"laptop (10.0.0.1)"}, names(resolver.Leases([]*parser.Lease{renewed, second})),
+		"client that claims the name again is the newest")
+}
+
+func TestConflictsAreCounted(t *testing.T) {
+	now := time.Now()
+	leases := []*parser.Lease{
+		lease("laptop", "10.0.0.1", "00:00:00:00:00:01", now),
+		lease("laptop", "10.0.0.2", "00:00:00:00:00:02", now),
+	}
+
+	resolver, err := collision.NewResolver(collision.PolicyAllow, zaptest.NewLogger(t))
+	assert.NoError(t, err)
+
+	before := conflicts(t)
+	resolver.Leases(leases)
+	resolver.Leases(leases)
+	assert.Equal(t, before+1, conflicts(t), "conflict is counted when it appears")
+
+	resolver.Leases(append(leases, lease("laptop", "10.0.0.3", "00:00:00:00:00:03", now)))
+	assert.Equal(t, before+2, conflicts(t), "another client claiming the name is counted")
+}
+
+func conflicts(t *testing.T) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == "dhcpd_coredns_name_conflicts_total" {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestCollisionFallbacks(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	now := time.Now()
+	withoutHardware := lease("host", "2001:db8::1", "", time.Time{})
+	withoutHardware.Cltt = now
+	leases := []*parser.Lease{
+		withoutHardware,
+		lease("host", "10.0.0.1", "00:00:00:00:00:01", now.Add(-time.Minute)),
+	}
+
+	resolver, err := collision.NewResolver(collision.PolicySuffix, logger)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		[]string{"host (10.0.0.1)", "host-2001-0db8-0000-0000-0000-0000-0000-0001 (2001:db8::1)"},
+		names(resolver.Leases(leases)))
+}
+
+func TestCollisionSuffixLimits(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	now := time.Now()
+	resolver, err := collision.NewResolver(collision.PolicySuffix, logger)
+	assert.NoError(t, err)
+
+	// the suffixed name of the second laptop is the name of a third client
+	leases := []*parser.Lease{
+		lease("laptop", "10.0.0.1", "00:00:00:00:00:01", now.Add(-time.Hour)),
+		lease("laptop", "10.0.0.2", "00:00:00:00:00:02", now),
+		lease("laptop-000000000002", "10.0.0.3", "00:00:00:00:00:03", now),
+	}
+	assert.Equal(t, []string{"laptop (10.0.0.1)", "laptop-000000000002 (10.0.0.3)"}, names(resolver.Leases(leases)),
+		"suffixed name does not take the name of another client")
+
+	domain := strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("a", 50)
+	leases = []*parser.Lease{
+		lease("host."+domain, "10.0.0.1", "00:00:00:00:00:01", now.Add(-time.Hour)),
+		lease("host."+domain, "10.0.0.2", "00:00:00:00:00:02", now),
+		lease("h."+domain[12:], "10.0.0.3", "00:00:00:00:00:01", now.Add(-time.Hour)),
+		lease("h."+domain[12:], "10.0.0.4", "00:00:00:00:00:02", now),
+	}
+	result := resolver.Leases(leases)
+	if assert.Len(t, result, 3, "client is left out if the name has no room for the suffix") {
+		assert.Equal(t, "h-000000000002."+domain[12:], result[2].Name)
+		assert.LessOrEqual(t, len(result[2].Name), 253, "suffixed name stays within the name length limit")
+	}
+}
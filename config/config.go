@@ -1,18 +1,38 @@
 package config
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"inet.af/netaddr"
 )
 
 type Config struct {
+	// Backend selects where the records are published, either etcd,
+	// rfc2136, hosts, zonefile or redis
+	Backend         string
 	Etcd            clientv3.Config
+	RFC2136         RFC2136Config
+	Hosts           HostsConfig
+	ZoneFile        ZoneFileConfig
+	Redis           RedisConfig
 	KeyPrefix       PrefixConfig
-	Lease           LeaseConfig
+	Reverse         ReverseConfig
+	Lease           []LeaseConfig
 	CleanupInterval time.Duration
 	LogLevel        string
+	// Expiry selects how records of expired leases are removed, either by
+	// heartbeat keys or by etcd leases
+	Expiry string
+	// Metrics is the address to serve Prometheus metrics on at /metrics,
+	// e.g. :9153, they are not served if empty
+	Metrics string
+	// DryRun publishes the leases to an in-memory backend that only logs
+	// its changes instead of the configured backend
+	DryRun bool
 }
 
 type PrefixConfig struct {
@@ -20,14 +40,256 @@ type PrefixConfig struct {
 	Heartbeat string
 }
 
+// ReverseConfig configures the PTR records of the published leases.
+type ReverseConfig struct {
+	// Prefix is the root key prefix of the in-addr.arpa and ip6.arpa
+	// zones, e.g. /skydns/, and disables PTR records if empty. The zones of
+	// the lease sources must be below it.
+	Prefix string
+	// Zones limits the PTR records to addresses in these networks, e.g.
+	// 10.0.0.0/8 for the zone 10.in-addr.arpa. The etcd backend writes PTR
+	// records for all addresses if empty, the rfc2136 backend needs the
+	// zones to send the updates to.
+	Zones []string
+}
+
+// RFC2136Config configures a name server that accepts dynamic updates.
+type RFC2136Config struct {
+	// Server is the address of the primary name server, e.g.
+	// ns1.example.com:53
+	Server string
+	// Zone is the zone the leases are added to, e.g. example.com. The
+	// PTR records are added to the zones of the reverse networks.
+	Zone string
+	// Net is the transport of the updates, either udp or tcp
+	Net     string
+	Timeout time.Duration
+	TTL     uint32
+	TSIG    TSIGConfig
+	// State is the file that keeps the records written by the backend and
+	// their deadlines across restarts, so that they are still removed. The
+	// records are only kept in memory if empty.
+	State string
+	// Resend is the interval at which the records are sent again, so that
+	// records the server has lost, e.g. by reloading the zone, are
+	// restored. Only records whose updates failed are sent again if zero.
+	Resend time.Duration
+}
+
+// TSIGConfig configures the key that signs the updates. Updates are not
+// signed if Name is empty.
+type TSIGConfig struct {
+	Name string
+	// Algorithm defaults to hmac-sha256
+	Algorithm string
+	// Secret is the base64 encoded key
+	Secret string
+}
+
+// HostsConfig configures a hosts file that is served by e.g. the hosts
+// plugin of CoreDNS or dnsmasq.
+type HostsConfig struct {
+	File string
+	// State is the file that keeps the heartbeats of the records across
+	// restarts and defaults to the hosts file with .state appended
+	State string
+	// Domain is appended to the names of the leases, the names are listed
+	// as aliases.
+	Domain string
+}
+
+// ZoneFileConfig configures master files that are loaded by e.g. the file
+// plugin of CoreDNS or BIND.
+type ZoneFileConfig struct {
+	// File is the master file of the forward zone
+	File string
+	// ReverseDir is the directory of the master files of the zones of the
+	// reverse networks, one per zone named db. followed by the zone, e.g.
+	// db.10.in-addr.arpa. PTR records are not written if empty.
+	ReverseDir string
+	// Origin is the domain of the forward zone, e.g. example.com
+	Origin      string
+	NameServers []string
+	// Hostmaster is the mailbox of the SOA records and defaults to
+	// hostmaster in the forward zone
+	Hostmaster string
+	TTL        uint32
+}
+
+// RedisConfig configures a Redis server that is read by the redis plugin of
+// CoreDNS. The records expire by HEXPIRE, which needs Redis 7.4 or later.
+type RedisConfig struct {
+	Address  string
+	Username string
+	Password string
+	DB       int
+	// Zone is the zone the leases are added to, e.g. example.com
+	Zone string
+	// KeyPrefix and KeySuffix are added to the zone to get the key of its
+	// hash and have to match the settings of the plugin.
+	KeyPrefix string
+	KeySuffix string
+	TTL       uint32
+}
+
+// LeaseConfig configures a single lease source.
 type LeaseConfig struct {
-	File    string
+	// Name separates the heartbeats of the source from those of other
+	// sources, it may only be omitted if there is a single source
+	Name string
+	File string
+	// Zone is the key prefix of the records of this source and defaults to
+	// the zone key prefix. Backends without keys add the records below the
+	// domain of this prefix relative to the zone key prefix, e.g.
+	// vlan10.example.com for /skydns/com/example/vlan10/.
+	Zone string
+	// Format is the lease file format, either dhcpd, dnsmasq or kea
+	Format  string
 	Timeout time.Duration
+	// States lists the binding states of leases that are published
+	States []string
+	// Watcher selects how changes of the file are detected, either notify
+	// or poll for file systems without inotify support
+	Watcher      string
+	PollInterval time.Duration
+	// HostnamePolicy decides whether hostnames that are not valid DNS
+	// names are rewritten or rejected
+	HostnamePolicy string
+	// CollisionPolicy decides which leases are published if different
+	// clients have the same hostname, either allow, newest, first or suffix
+	CollisionPolicy string
+	// Reconcile removes the records of leases that disappeared from the
+	// lease file on every sync instead of after the lease timeout
+	Reconcile bool
 }
 
 func SetDefaults(vp *viper.Viper) {
 	vp.SetDefault("cleanupInterval", time.Minute)
-	vp.SetDefault("lease.timeout", time.Minute)
 	vp.SetDefault("logLevel", "info")
+	vp.SetDefault("expiry", "heartbeat")
+	vp.SetDefault("backend", "etcd")
+	vp.SetDefault("rfc2136.net", "udp")
+	vp.SetDefault("rfc2136.timeout", time.Second*3)
+	vp.SetDefault("rfc2136.ttl", 60)
+	vp.SetDefault("zonefile.ttl", 60)
+	vp.SetDefault("redis.address", "localhost:6379")
+	vp.SetDefault("redis.ttl", 60)
 	vp.SetDefault("etcd.dialTimeout", time.Second*3)
 }
+
+// SetLeaseDefaults fills in the settings that the lease sources in vp left
+// out. Viper cannot set defaults for the elements of a list, so these are
+// added to the sources before the configuration is unmarshalled.
+func SetLeaseDefaults(vp *viper.Viper) {
+	var sources []interface{}
+	switch lease := vp.Get("lease").(type) {
+	case []interface{}:
+		sources = lease
+	case map[string]interface{}:
+		// a single source may be configured without a list
+		sources = []interface{}{lease}
+	default:
+		return
+	}
+
+	defaults := map[string]interface{}{
+		"zone":            vp.GetString("keyPrefix.zone"),
+		"timeout":         time.Minute,
+		"states":          []string{"active"},
+		"format":          "dhcpd",
+		"watcher":         "notify",
+		"pollInterval":    time.Second * 5,
+		"hostnamePolicy":  "rewrite",
+		"collisionPolicy": "allow",
+	}
+
+	for i, source := range sources {
+		settings, ok := source.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		merged := make(map[string]interface{}, len(defaults)+len(settings))
+		for key, value := range defaults {
+			merged[strings.ToLower(key)] = value
+		}
+		for key, value := range settings {
+			merged[strings.ToLower(key)] = value
+		}
+		sources[i] = merged
+	}
+	vp.Set("lease", sources)
+}
+
+// Validate checks that the lease sources can be told apart and have valid
+// settings.
+func (c *Config) Validate() error {
+	if len(c.Lease) == 0 {
+		return ErrNoLeaseSource
+	}
+
+	switch c.Backend {
+	case "", "etcd", "rfc2136", "hosts", "zonefile", "redis":
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownBackend, c.Backend)
+	}
+
+	switch c.Expiry {
+	case "", "heartbeat", "lease":
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownExpiry, c.Expiry)
+	}
+
+	names := make(map[string]struct{}, len(c.Lease))
+	for _, lease := range c.Lease {
+		if lease.Name == "" && len(c.Lease) > 1 {
+			return fmt.Errorf("%w: %v", ErrMissingSourceName, lease.File)
+		}
+		if strings.Contains(lease.Name, "/") {
+			return fmt.Errorf("%w: %q", ErrInvalidSourceName, lease.Name)
+		}
+		if _, ok := names[lease.Name]; ok {
+			return fmt.Errorf("%w: %q", ErrDuplicateSourceName, lease.Name)
+		}
+		names[lease.Name] = struct{}{}
+
+		if lease.Timeout <= 0 {
+			return fmt.Errorf("%w: %v", ErrInvalidTimeout, lease.Timeout)
+		}
+
+		// the reverse prefix is a key prefix of the etcd backend only
+		etcd := c.Backend == "" || c.Backend == "etcd"
+		if etcd && c.Reverse.Prefix != "" && !strings.HasPrefix(lease.Zone, c.Reverse.Prefix) {
+			return fmt.Errorf("%w: %v", ErrZoneOutsideReverse, lease.Zone)
+		}
+	}
+
+	for _, zone := range c.Reverse.Zones {
+		prefix, err := netaddr.ParseIPPrefix(zone)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidReverseZone, err)
+		}
+		// reverse zones are cut at octets of IPv4 and nibbles of IPv6
+		// addresses
+		if (prefix.IP().Is4() && prefix.Bits()%8 != 0) || prefix.Bits()%4 != 0 || prefix.Masked() != prefix {
+			return fmt.Errorf("%w: %v", ErrInvalidReverseZone, zone)
+		}
+	}
+	return nil
+}
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrNoLeaseSource       = Error("no lease source configured")
+	ErrMissingSourceName   = Error("lease sources need a name if there are several")
+	ErrInvalidSourceName   = Error("lease source name must not contain a slash")
+	ErrDuplicateSourceName = Error("duplicate lease source name")
+	ErrInvalidTimeout      = Error("lease timeout must be positive")
+	ErrZoneOutsideReverse  = Error("lease zone is not below the reverse key prefix")
+	ErrInvalidReverseZone  = Error("invalid reverse zone")
+	ErrUnknownBackend      = Error("unknown backend")
+	ErrUnknownExpiry       = Error("unknown record expiry")
+)
@@ -0,0 +1,172 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func readConfig(t *testing.T, yaml string) *config.Config {
+	vp := viper.New()
+	config.SetDefaults(vp)
+	vp.SetConfigType("yaml")
+	assert.NoError(t, vp.ReadConfig(strings.NewReader(yaml)))
+	config.SetLeaseDefaults(vp)
+
+	var cfg config.Config
+	assert.NoError(t, vp.Unmarshal(&cfg))
+	return &cfg
+}
+
+func TestLeaseSources(t *testing.T) {
+	cfg := readConfig(t, `
+keyPrefix:
+  zone: /skydns/test/
+lease:
+- name: vlan10
+  file: /var/lib/dhcp/vlan10.leases
+  zone: /skydns/test/vlan10/
+  states: [active, backup]
+- name: vlan20
+  file: /var/lib/misc/dnsmasq.leases
+  format: dnsmasq
+  timeout: 10s
+`)
+
+	assert.NoError(t, cfg.Validate())
+	assert.Len(t, cfg.Lease, 2)
+
+	assert.Equal(t, "/skydns/test/vlan10/", cfg.Lease[0].Zone)
+	assert.Equal(t, []string{"active", "backup"}, cfg.Lease[0].States)
+	assert.Equal(t, "dhcpd", cfg.Lease[0].Format)
+	assert.Equal(t, time.Minute, cfg.Lease[0].Timeout)
+
+	assert.Equal(t, "/skydns/test/", cfg.Lease[1].Zone)
+	assert.Equal(t, []string{"active"}, cfg.Lease[1].States)
+	assert.Equal(t, "dnsmasq", cfg.Lease[1].Format)
+	assert.Equal(t, 10*time.Second, cfg.Lease[1].Timeout)
+}
+
+func TestSingleLeaseSource(t *testing.T) {
+	cfg := readConfig(t, `
+lease:
+  file: /var/lib/dhcp/dhcpd.leases
+  timeout: 10s
+`)
+
+	assert.NoError(t, cfg.Validate())
+	assert.Len(t, cfg.Lease, 1)
+	assert.Equal(t, "/var/lib/dhcp/dhcpd.leases", cfg.Lease[0].File)
+	assert.Equal(t, 10*time.Second, cfg.Lease[0].Timeout)
+}
+
+func TestValidateSourceNames(t *testing.T) {
+	cfg := readConfig(t, `
+lease:
+- file: a.leases
+- file: b.leases
+`)
+	assert.ErrorIs(t, cfg.Validate(), config.ErrMissingSourceName)
+
+	cfg = readConfig(t, `
+lease:
+- name: a
+  file: a.leases
+- name: a
+  file: b.leases
+`)
+	assert.ErrorIs(t, cfg.Validate(), config.ErrDuplicateSourceName)
+
+	cfg = readConfig(t, `logLevel: info`)
+	assert.ErrorIs(t, cfg.Validate(), config.ErrNoLeaseSource)
+}
+
+func TestValidateTimeout(t *testing.T) {
+	cfg := readConfig(t, `
+lease:
+  file: a.leases
+  timeout: 0
+`)
+	assert.Equal(t, time.Duration(0), cfg.Lease[0].Timeout, "explicit timeout is kept")
+	assert.ErrorIs(t, cfg.Validate(), config.ErrInvalidTimeout)
+}
+
+func TestValidateExpiry(t *testing.T) {
+	cfg := readConfig(t, `
+expiry: lease
+lease:
+  file: a.leases
+`)
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Expiry = "ttl"
+	assert.ErrorIs(t, cfg.Validate(), config.ErrUnknownExpiry)
+}
+
+func TestValidateReverse(t *testing.T) {
+	cfg := readConfig(t, `
+keyPrefix:
+  zone: /skydns/test/
+reverse:
+  prefix: /skydns/
+  zones: [10.0.0.0/8, 2001:db8::/32]
+lease:
+  file: a.leases
+`)
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Reverse.Zones = []string{"10.0.0.0/12"}
+	assert.ErrorIs(t, cfg.Validate(), config.ErrInvalidReverseZone)
+
+	cfg.Reverse.Zones = []string{"2001:db8::/30"}
+	assert.ErrorIs(t, cfg.Validate(), config.ErrInvalidReverseZone)
+
+	cfg.Reverse.Zones = nil
+	cfg.Reverse.Prefix = "/coredns/"
+	assert.ErrorIs(t, cfg.Validate(), config.ErrZoneOutsideReverse)
+
+	cfg.Backend = "rfc2136"
+	assert.NoError(t, cfg.Validate(), "the reverse prefix is only used by etcd")
+}
+
+func TestBackend(t *testing.T) {
+	cfg := readConfig(t, `
+lease:
+  file: a.leases
+`)
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, "etcd", cfg.Backend)
+
+	cfg = readConfig(t, `
+backend: rfc2136
+rfc2136:
+  server: 127.0.0.1:53
+  zone: example.com.
+  tsig:
+    name: update.
+    secret: c2VjcmV0
+lease:
+  file: a.leases
+`)
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, "127.0.0.1:53", cfg.RFC2136.Server)
+	assert.Equal(t, "udp", cfg.RFC2136.Net)
+	assert.Equal(t, uint32(60), cfg.RFC2136.TTL)
+	assert.Equal(t, "update.", cfg.RFC2136.TSIG.Name)
+
+	cfg.Backend = "hosts"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Backend = "zonefile"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Backend = "redis"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Backend = "bind"
+	assert.ErrorIs(t, cfg.Validate(), config.ErrUnknownBackend)
+}
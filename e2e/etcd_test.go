@@ -9,10 +9,12 @@ import (
 
 	"github.com/heilerich/dhcpd-coredns/backend/etcd"
 	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/heilerich/dhcpd-coredns/parser"
 	"github.com/heilerich/dhcpd-coredns/watcher"
 	"github.com/stretchr/testify/assert"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap/zaptest"
+	"inet.af/netaddr"
 )
 
 func TestEtcdWithLeaseFile(t *testing.T) {
@@ -39,21 +41,26 @@ func TestEtcdWithLeaseFile(t *testing.T) {
 			Zone:      zonePrefix,
 			Heartbeat: heartBeatPrefix,
 		},
-		Lease: config.LeaseConfig{
+		Lease: []config.LeaseConfig{{
 			File:    leaseFile.Name(),
+			Zone:    zonePrefix,
 			Timeout: 0,
-		},
+			States:  []string{"active"},
+		}},
 	}
 
-	backend, err := etcd.NewEtcdBackend(cfg, logger)
+	etcdBackend, err := etcd.NewEtcdBackend(cfg, logger)
 	if err != nil {
 		t.Fatalf("failed to initialize backend: %v", err)
 	}
+	backend := etcdBackend.ForSource(&cfg.Lease[0])
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	watcher.CoordinateWatcher(ctx, leaseFile.Name(), backend, logger, func() {}, func() {})
+	fileWatcher := watcher.NewNotifyWatcher(leaseFile.Name(), logger)
+	leaseSource := watcher.NewFileSource(leaseFile.Name(), parser.NewParser(logger), fileWatcher, logger)
+	watcher.CoordinateWatcher(ctx, &cfg.Lease[0], leaseSource, backend, logger, func() {}, func() {})
 
 	// give fs watcher time to start
 	time.Sleep(10 * time.Millisecond)
@@ -84,3 +91,57 @@ func TestEtcdWithLeaseFile(t *testing.T) {
 	leaseFile.Close()
 	os.Remove(leaseFile.Name())
 }
+
+func TestEtcdLeaseExpiry(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	zoneSuffix := randomSuffix(5)
+	zonePrefix := fmt.Sprintf("/skydns/test/%v/", zoneSuffix)
+	heartBeatPrefix := fmt.Sprintf("/dhcpd/%v/", zoneSuffix)
+
+	cfg := &config.Config{
+		Etcd: clientv3.Config{
+			Endpoints: []string{"http://etcd:2379"},
+			Username:  "test-user",
+			Password:  "test-pass",
+		},
+		KeyPrefix: config.PrefixConfig{
+			Zone:      zonePrefix,
+			Heartbeat: heartBeatPrefix,
+		},
+		Expiry: etcd.ExpiryLease,
+	}
+
+	backend, err := etcd.NewEtcdBackend(cfg, logger)
+	if err != nil {
+		t.Fatalf("failed to initialize backend: %v", err)
+	}
+	defer backend.Close(context.Background())
+
+	client, err := clientv3.New(cfg.Etcd)
+	if err != nil {
+		t.Fatalf("failed to connect to etcd: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lease := &parser.Lease{Name: "expiring", Address: netaddr.MustParseIP("1.1.1.1"), Ends: time.Now().Add(time.Second)}
+	assert.NoError(t, backend.Put(ctx, lease))
+
+	resp, err := client.Get(ctx, zonePrefix, clientv3.WithPrefix())
+	if assert.NoError(t, err) && assert.Len(t, resp.Kvs, 1, "record is written") {
+		assert.NotZero(t, resp.Kvs[0].Lease, "record is attached to an etcd lease")
+	}
+
+	resp, err = client.Get(ctx, heartBeatPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if assert.NoError(t, err) {
+		assert.Zero(t, resp.Count, "no heartbeat key is written")
+	}
+
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get(ctx, zonePrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		return err == nil && resp.Count == 0
+	}, 8*time.Second, 200*time.Millisecond, "etcd removes the record when the lease ends")
+}
@@ -36,7 +36,10 @@ func (b *backendMock) WaitForExpectations(ctx context.Context) {
 
 func (b *backendMock) ExpectLeases(leases ...*parser.Lease) {
 	for _, lease := range leases {
-		b.On("Put", lease).Return(nil)
+		expected := lease.String()
+		b.On("Put", mock.MatchedBy(func(actual backend.Lease) bool {
+			return actual.(*parser.Lease).String() == expected
+		})).Return(nil)
 	}
 }
 
@@ -18,12 +18,12 @@ func templateLease(lease *parser.Lease) string {
 	return fmt.Sprintf(`
 lease %v {
 	starts 5 2022/06/03 12:18:58;
-	ends 5 2022/06/03 12:20:58;
+	ends never;
 	tstp 5 2022/06/03 12:20:58;
 	tsfp 5 2022/06/03 12:20:58;
 	atsfp 5 2022/06/03 12:20:58;
 	cltt 5 2022/06/03 12:18:58;
-	binding state free;
+	binding state active;
 	hardware ethernet 00:50:56:af:a4:d5;
 	uid "\377-\032\2413\000\002\000\000\253\021\261L\001}\301\202~\213";
 	client-hostname "%v";
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,9 +11,18 @@ import (
 
 	"github.com/heilerich/dhcpd-coredns/backend"
 	"github.com/heilerich/dhcpd-coredns/backend/etcd"
+	"github.com/heilerich/dhcpd-coredns/backend/hosts"
+	"github.com/heilerich/dhcpd-coredns/backend/memory"
+	"github.com/heilerich/dhcpd-coredns/backend/redis"
+	"github.com/heilerich/dhcpd-coredns/backend/rfc2136"
+	"github.com/heilerich/dhcpd-coredns/backend/zonefile"
+	"github.com/heilerich/dhcpd-coredns/collision"
 	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"github.com/heilerich/dhcpd-coredns/sanitize"
 	"github.com/heilerich/dhcpd-coredns/util"
 	"github.com/heilerich/dhcpd-coredns/watcher"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -43,10 +54,10 @@ func main() {
 
 	shutdownWg := &util.TimeoutGroup{}
 
-	etcdBackend, err := etcd.NewEtcdBackend(cfg, logger)
-	if err != nil {
-		logger.Fatal("failed to init etcd backend", zap.Error(err))
-	}
+	metricsServer := serveMetrics(cfg.Metrics, logger)
+
+	newSourceBackend, closeBackend := newBackend(cfg, logger)
+	sourceBackends := []backend.Backend{}
 
 	onStart := func() {
 		shutdownWg.Add(1)
@@ -56,16 +67,36 @@ func main() {
 		shutdownWg.Done()
 	}
 
-	syncFn := watcher.CoordinateWatcher(ctx, cfg.Lease.File, etcdBackend, logger, onStart, onStop)
+	for i := range cfg.Lease {
+		leaseCfg := &cfg.Lease[i]
+		sourceLogger := logger.With(zap.String("source", leaseCfg.Name), zap.String("file", leaseCfg.File))
 
-	go func() {
-		if err := backend.RunCleaner(ctx, etcdBackend, syncFn, cfg); err != nil {
-			logger.Warn("backend cleaning failed", zap.Error(err))
+		leaseSource := newLeaseSource(leaseCfg, sourceLogger)
+		sourceBackend := newSourceBackend(leaseCfg, sourceLogger)
+		sourceBackends = append(sourceBackends, sourceBackend)
+
+		sanitizer, err := sanitize.NewSanitizer(leaseCfg.HostnamePolicy, sourceLogger)
+		if err != nil {
+			sourceLogger.Fatal("failed to init hostname sanitizer", zap.Error(err))
 		}
-		logger.Info("backend cleaner stopped")
-		cancel()
-		shutdownWg.Done()
-	}()
+
+		resolver, err := collision.NewResolver(leaseCfg.CollisionPolicy, sourceLogger)
+		if err != nil {
+			sourceLogger.Fatal("failed to init hostname collision resolver", zap.Error(err))
+		}
+
+		syncFn := watcher.CoordinateWatcher(ctx, leaseCfg, leaseSource, sourceBackend, sourceLogger, onStart, onStop,
+			sanitizer.Leases, resolver.Leases)
+
+		onStart()
+		go func() {
+			if err := backend.RunCleaner(ctx, sourceBackend, syncFn, cfg); err != nil {
+				sourceLogger.Warn("backend cleaning failed", zap.Error(err))
+			}
+			sourceLogger.Info("backend cleaner stopped")
+			onStop()
+		}()
+	}
 
 	<-ctx.Done()
 
@@ -74,9 +105,112 @@ func main() {
 	if err := shutdownWg.WaitWithTimeout(shutdownCtx, 10*time.Second); err != nil {
 		logger.Warn("orderly shutdown failed, terminating", zap.Error(err))
 	}
+
+	// the backends of the sources share the connection of the backend they
+	// have been built from, which is closed last
+	closeCtx, closeCancel := context.WithTimeout(shutdownCtx, 10*time.Second)
+	defer closeCancel()
+	for _, sourceBackend := range sourceBackends {
+		if err := sourceBackend.Close(closeCtx); err != nil {
+			logger.Warn("failed to close source backend", zap.Error(err))
+		}
+	}
+	if err := closeBackend(closeCtx); err != nil {
+		logger.Warn("failed to close backend", zap.Error(err))
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(closeCtx); err != nil {
+			logger.Warn("failed to stop metrics server", zap.Error(err))
+		}
+	}
 	logger.Info("exit")
 }
 
+// serveMetrics serves the Prometheus metrics on addr unless it is empty.
+func serveMetrics(addr string, logger *zap.Logger) *http.Server {
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("failed to serve metrics", zap.Error(err))
+		}
+	}()
+	return server
+}
+
+// newBackend returns a function that builds the backend of a lease source
+// and a function that closes the backend the sources have been built from.
+func newBackend(cfg *config.Config, logger *zap.Logger) (func(*config.LeaseConfig, *zap.Logger) backend.Backend, func(context.Context) error) {
+	if cfg.DryRun {
+		logger.Info("dry run, records are not published")
+		return func(leaseCfg *config.LeaseConfig, logger *zap.Logger) backend.Backend {
+			return memory.NewMemoryBackend(leaseCfg.Timeout, logger)
+		}, func(context.Context) error { return nil }
+	}
+
+	switch cfg.Backend {
+	case "rfc2136":
+		updateBackend, err := rfc2136.NewUpdateBackend(cfg, logger)
+		if err != nil {
+			logger.Fatal("failed to init rfc2136 backend", zap.Error(err))
+		}
+		return func(leaseCfg *config.LeaseConfig, logger *zap.Logger) backend.Backend {
+			return updateBackend.ForSource(leaseCfg)
+		}, updateBackend.Close
+	case "hosts":
+		hostsBackend, err := hosts.NewHostsBackend(cfg, logger)
+		if err != nil {
+			logger.Fatal("failed to init hosts backend", zap.Error(err))
+		}
+		return func(leaseCfg *config.LeaseConfig, logger *zap.Logger) backend.Backend {
+			return hostsBackend.ForSource(leaseCfg)
+		}, hostsBackend.Close
+	case "zonefile":
+		zoneBackend, err := zonefile.NewZoneBackend(cfg, logger)
+		if err != nil {
+			logger.Fatal("failed to init zone file backend", zap.Error(err))
+		}
+		return func(leaseCfg *config.LeaseConfig, logger *zap.Logger) backend.Backend {
+			return zoneBackend.ForSource(leaseCfg)
+		}, zoneBackend.Close
+	case "redis":
+		redisBackend, err := redis.NewRedisBackend(cfg, logger)
+		if err != nil {
+			logger.Fatal("failed to init redis backend", zap.Error(err))
+		}
+		return func(leaseCfg *config.LeaseConfig, logger *zap.Logger) backend.Backend {
+			return redisBackend.ForSource(leaseCfg)
+		}, redisBackend.Close
+	}
+
+	etcdBackend, err := etcd.NewEtcdBackend(cfg, logger)
+	if err != nil {
+		logger.Fatal("failed to init etcd backend", zap.Error(err))
+	}
+	return func(leaseCfg *config.LeaseConfig, logger *zap.Logger) backend.Backend {
+		return etcdBackend.ForSource(leaseCfg)
+	}, etcdBackend.Close
+}
+
+func newLeaseSource(leaseCfg *config.LeaseConfig, logger *zap.Logger) watcher.LeaseSource {
+	leaseParser, err := parser.NewFormatParser(leaseCfg.Format, logger)
+	if err != nil {
+		logger.Fatal("failed to init lease parser", zap.Error(err))
+	}
+
+	fileWatcher, err := watcher.NewFileWatcher(leaseCfg, logger)
+	if err != nil {
+		logger.Fatal("failed to init file watcher", zap.Error(err))
+	}
+
+	return watcher.NewFileSource(leaseCfg.File, leaseParser, fileWatcher, logger)
+}
+
 func initConfig(logger *zap.Logger) *config.Config {
 	vp := viper.New()
 
@@ -87,8 +221,13 @@ func initConfig(logger *zap.Logger) *config.Config {
 	vp.AddConfigPath("/etc/dhcpd-coredns")
 
 	configPath := pflag.StringP("config", "c", "", "config path")
+	pflag.Bool("dry-run", false, "log the records instead of publishing them")
 	pflag.Parse()
 
+	if err := vp.BindPFlag("dryRun", pflag.Lookup("dry-run")); err != nil {
+		logger.Fatal("failed to bind flag", zap.Error(err))
+	}
+
 	if *configPath != "" {
 		vp.SetConfigFile(*configPath)
 	}
@@ -103,7 +242,15 @@ func initConfig(logger *zap.Logger) *config.Config {
 		logger.Info("read configuration file", zap.String("path", vp.ConfigFileUsed()))
 	}
 
-	var config config.Config
-	vp.Unmarshal(&config)
-	return &config
+	config.SetLeaseDefaults(vp)
+
+	var cfg config.Config
+	if err := vp.Unmarshal(&cfg); err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logger.Fatal("invalid config", zap.Error(err))
+	}
+	return &cfg
 }
@@ -0,0 +1,130 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// dnsmasqFormat reads the lease file of dnsmasq. Every line holds one lease
+// as `expiry hwaddr address hostname client-id`. A `duid` line starts the
+// DHCPv6 section, where the hardware address is replaced by the IAID.
+type dnsmasqFormat struct {
+	logger *zap.Logger
+}
+
+func (f *dnsmasqFormat) parse(ctx context.Context, data []byte, handler func(*Lease)) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	v6 := false
+	count := 0
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "duid" {
+			v6 = true
+			continue
+		}
+
+		lease, err := parseDnsmasqLine(fields, v6)
+		if err != nil {
+			f.logger.Warn("skipping unparsable lease", zap.Int("line", lineNumber), zap.Error(err))
+			continue
+		}
+
+		count += 1
+		if lease.Name == "" {
+			continue
+		}
+		handler(lease)
+	}
+
+	f.logger.Debug("parsed dnsmasq leases", zap.Int("count", count))
+	return scanner.Err()
+}
+
+func parseDnsmasqLine(fields []string, v6 bool) (*Lease, error) {
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields, got %d", ErrSyntax, len(fields))
+	}
+
+	expiry, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid expiry: %v", ErrSyntax, err)
+	}
+
+	address, err := netaddr.ParseIP(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid address: %v", ErrSyntax, err)
+	}
+
+	// dnsmasq only keeps leases that have not been released or expired
+	lease := &Lease{Address: address, BindingState: "active"}
+
+	if expiry != 0 {
+		lease.Ends = time.Unix(expiry, 0).UTC()
+	}
+
+	if fields[3] != "*" {
+		lease.Name = hostLabel(fields[3])
+	}
+
+	if fields[4] != "*" {
+		if id, err := parseHex(fields[4]); err == nil {
+			lease.UID = string(id)
+		} else {
+			lease.UID = fields[4]
+		}
+	}
+
+	if !v6 {
+		lease.HardwareType, lease.Hardware, err = parseDnsmasqHardware(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid hardware address: %v", ErrSyntax, err)
+		}
+	}
+
+	return lease, nil
+}
+
+// parseDnsmasqHardware parses a hardware address, which dnsmasq prefixes
+// with the ARP hardware type unless it is ethernet.
+func parseDnsmasqHardware(field string) (string, net.HardwareAddr, error) {
+	hwType := "ethernet"
+	if len(field) > 3 && field[2] == '-' {
+		arpType, err := strconv.ParseUint(field[:2], 16, 8)
+		if err != nil {
+			return "", nil, err
+		}
+		hwType = arpHardwareTypes[arpType]
+		if hwType == "" {
+			hwType = fmt.Sprint(arpType)
+		}
+		field = field[3:]
+	}
+
+	addr, err := parseHex(field)
+	return hwType, addr, err
+}
+
+var arpHardwareTypes = map[uint64]string{
+	1:  "ethernet",
+	6:  "token-ring",
+	8:  "fddi",
+	32: "infiniband",
+}
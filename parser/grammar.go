@@ -0,0 +1,662 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// leaseBlock holds everything dhcpd writes into a single lease declaration.
+type leaseBlock struct {
+	lease *Lease
+
+	tstp, tsfp, atsfp time.Time
+
+	nextBindingState, rewindBindingState string
+
+	// events lists the events of on statements, e.g. commit or expiry
+	events []string
+}
+
+type failoverPeer struct {
+	name                  string
+	myState, partnerState string
+	mySince, partnerSince time.Time
+}
+
+// leaseFile collects the top level declarations of a lease file that are not
+// lease declarations.
+type leaseFile struct {
+	authoringByteOrder string
+	serverDUID         string
+	failoverPeers      []*failoverPeer
+}
+
+// grammar implements the dhcpd.leases(5) grammar on top of the lexer.
+type grammar struct {
+	lex    *lexer
+	peeked *token
+	depth  int
+	file   leaseFile
+	// pending holds the remaining addresses of an identity association
+	pending []*leaseBlock
+
+	// end is the offset after the last token read and consumed the offset
+	// after the last complete top level declaration
+	end, consumed int
+	eof           bool
+}
+
+func newGrammar(data []byte) *grammar {
+	return &grammar{lex: newLexer(data)}
+}
+
+func (g *grammar) peek() (token, error) {
+	if g.peeked != nil {
+		return *g.peeked, nil
+	}
+
+	tok, err := g.lex.next()
+	if err != nil {
+		return tok, err
+	}
+	g.peeked = &tok
+	return tok, nil
+}
+
+func (g *grammar) next() (token, error) {
+	tok, err := g.peek()
+	if err != nil {
+		// the lexer continues after the offending token
+		g.end = g.lex.pos
+		return tok, err
+	}
+	g.peeked = nil
+	g.end = tok.offset
+	if tok.kind == tokenEOF {
+		g.eof = true
+	}
+
+	if tok.kind == tokenPunct {
+		switch tok.text {
+		case "{":
+			g.depth++
+		case "}":
+			if g.depth > 0 {
+				g.depth--
+			}
+		}
+	}
+	return tok, nil
+}
+
+func (g *grammar) expect(kind tokenKind, text string) (token, error) {
+	tok, err := g.next()
+	if err != nil {
+		return tok, err
+	}
+
+	if tok.kind != kind || (text != "" && tok.text != text) {
+		expected := kind.String()
+		if text != "" {
+			expected = fmt.Sprintf("%q", text)
+		}
+		return tok, syntaxError(tok, fmt.Sprintf("expected %v, got %v", expected, tok))
+	}
+	return tok, nil
+}
+
+func (g *grammar) expectWord() (string, error) {
+	tok, err := g.expect(tokenWord, "")
+	return tok.text, err
+}
+
+func (g *grammar) expectSemicolon() error {
+	_, err := g.expect(tokenPunct, ";")
+	return err
+}
+
+func syntaxError(tok token, msg string) error {
+	return fmt.Errorf("line %d: %w: %v", tok.line, ErrSyntax, msg)
+}
+
+// nextLease parses declarations until the next lease declaration has been
+// read. It returns io.EOF at the end of the data. After a syntax error the
+// grammar skips to the end of the offending declaration, so callers may
+// continue to call nextLease. Afterwards consumed is the number of bytes of
+// data that hold complete declarations.
+func (g *grammar) nextLease() (*leaseBlock, error) {
+	for {
+		if len(g.pending) > 0 {
+			block := g.pending[0]
+			g.pending = g.pending[1:]
+			return block, nil
+		}
+
+		tok, err := g.next()
+		if err != nil {
+			return nil, err
+		}
+
+		var block *leaseBlock
+		switch {
+		case tok.kind == tokenEOF:
+			return nil, io.EOF
+		case tok.is(tokenWord, "lease"):
+			block, err = g.parseLease()
+		case tok.is(tokenWord, "ia-na"), tok.is(tokenWord, "ia-ta"), tok.is(tokenWord, "ia-pd"):
+			g.pending, err = g.parseIA()
+		case tok.is(tokenWord, "failover"):
+			err = g.parseFailover()
+		case tok.is(tokenWord, "authoring-byte-order"):
+			g.file.authoringByteOrder, err = g.expectWord()
+			if err == nil {
+				err = g.expectSemicolon()
+			}
+		case tok.is(tokenWord, "server-duid"):
+			g.file.serverDUID, err = g.parseValue()
+			if err == nil {
+				err = g.expectSemicolon()
+			}
+		default:
+			// host, group, class and other declarations carry no lease information
+			err = g.skipStatement(tok)
+		}
+
+		if err != nil {
+			err = g.recover(err)
+			// a declaration cut off by the end of the data is not consumed,
+			// since dhcpd might still be writing it
+			if !g.truncated(err) {
+				g.consumed = g.end
+			}
+			return nil, err
+		}
+		g.consumed = g.end
+
+		if block != nil {
+			return block, nil
+		}
+	}
+}
+
+// recover skips tokens until the grammar is back at the top level, so that
+// parsing can continue with the next declaration.
+func (g *grammar) recover(err error) error {
+	for g.depth > 0 {
+		tok, lexErr := g.next()
+		if errors.Is(lexErr, ErrUnterminatedString) {
+			return lexErr
+		}
+		if lexErr == nil && tok.kind == tokenEOF {
+			break
+		}
+	}
+	return err
+}
+
+// truncated reports whether err stopped a declaration that has been cut off
+// by the end of the data rather than a declaration that is invalid.
+func (g *grammar) truncated(err error) bool {
+	return g.eof || errors.Is(err, ErrUnterminatedString)
+}
+
+// skipStatement skips a statement that started with tok, including a
+// block that might be attached to it.
+func (g *grammar) skipStatement(tok token) error {
+	depth := g.depth - 1
+	if tok.is(tokenPunct, "{") {
+		return g.skipUntilDepth(depth)
+	}
+	if tok.is(tokenPunct, ";") {
+		return nil
+	}
+
+	for {
+		tok, err := g.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case tok.kind == tokenEOF:
+			return syntaxError(tok, "unexpected end of file")
+		case tok.is(tokenPunct, ";"):
+			return nil
+		case tok.is(tokenPunct, "{"):
+			return g.skipUntilDepth(depth + 1)
+		}
+	}
+}
+
+func (g *grammar) skipUntilDepth(depth int) error {
+	for g.depth > depth {
+		tok, err := g.next()
+		if err != nil {
+			return err
+		}
+		if tok.kind == tokenEOF {
+			return syntaxError(tok, "unexpected end of file")
+		}
+	}
+	return nil
+}
+
+func (g *grammar) parseLease() (*leaseBlock, error) {
+	addrTok, err := g.expect(tokenWord, "")
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := netaddr.ParseIP(addrTok.text)
+	if err != nil {
+		return nil, syntaxError(addrTok, fmt.Sprintf("invalid lease address: %v", err))
+	}
+
+	return g.parseLeaseBody(&Lease{Address: address})
+}
+
+// parseLeaseBody reads the statements of a lease, iaaddr or iaprefix
+// declaration.
+func (g *grammar) parseLeaseBody(lease *Lease) (*leaseBlock, error) {
+	if _, err := g.expect(tokenPunct, "{"); err != nil {
+		return nil, err
+	}
+
+	block := &leaseBlock{lease: lease}
+
+	for {
+		tok, err := g.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok.is(tokenPunct, "}") {
+			return block, nil
+		}
+
+		if err := g.parseLeaseStatement(block, tok); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseIA reads a DHCPv6 identity association, which holds any number of
+// iaaddr or iaprefix declarations.
+func (g *grammar) parseIA() ([]*leaseBlock, error) {
+	id, err := g.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := g.expect(tokenPunct, "{"); err != nil {
+		return nil, err
+	}
+
+	var (
+		blocks []*leaseBlock
+		cltt   time.Time
+	)
+	for {
+		tok, err := g.next()
+		if err != nil {
+			return nil, err
+		}
+
+		var block *leaseBlock
+		switch {
+		case tok.is(tokenPunct, "}"):
+			for _, block := range blocks {
+				block.lease.UID = id
+				if block.lease.Cltt.IsZero() {
+					block.lease.Cltt = cltt
+				}
+				block.lease.Name = hostnameFromVariables(block.lease.Variables)
+			}
+			return blocks, nil
+		case tok.is(tokenWord, "cltt"):
+			cltt, err = g.parseDate()
+		case tok.is(tokenWord, "iaaddr"):
+			block, err = g.parseIAAddress()
+		case tok.is(tokenWord, "iaprefix"):
+			block, err = g.parseIAPrefix()
+		case tok.kind == tokenEOF:
+			err = syntaxError(tok, "unexpected end of file in identity association")
+		default:
+			err = g.skipStatement(tok)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		if block != nil {
+			blocks = append(blocks, block)
+		}
+	}
+}
+
+func (g *grammar) parseIAAddress() (*leaseBlock, error) {
+	addrTok, err := g.expect(tokenWord, "")
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := netaddr.ParseIP(addrTok.text)
+	if err != nil {
+		return nil, syntaxError(addrTok, fmt.Sprintf("invalid iaaddr address: %v", err))
+	}
+
+	return g.parseLeaseBody(&Lease{Address: address})
+}
+
+func (g *grammar) parseIAPrefix() (*leaseBlock, error) {
+	prefixTok, err := g.expect(tokenWord, "")
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := netaddr.ParseIPPrefix(prefixTok.text)
+	if err != nil {
+		return nil, syntaxError(prefixTok, fmt.Sprintf("invalid iaprefix: %v", err))
+	}
+
+	return g.parseLeaseBody(&Lease{Address: prefix.IP(), Prefix: prefix})
+}
+
+// hostnameVariables lists the variables that dhcpd6 leases may carry the
+// client's name in, in order of preference.
+var hostnameVariables = []string{"client-hostname", "ddns-fwd-name"}
+
+// hostnameFromVariables returns the host label of the first hostname
+// variable, since DHCPv6 leases have no client-hostname statement.
+func hostnameFromVariables(variables map[string]string) string {
+	for _, name := range hostnameVariables {
+		if value, ok := variables[name]; ok && value != "" {
+			return hostLabel(value)
+		}
+	}
+	return ""
+}
+
+func (g *grammar) parseLeaseStatement(block *leaseBlock, tok token) error {
+	if tok.kind != tokenWord {
+		if tok.kind == tokenEOF {
+			return syntaxError(tok, "unexpected end of file in lease declaration")
+		}
+		return g.skipStatement(tok)
+	}
+
+	var err error
+	switch tok.text {
+	case "starts":
+		block.lease.Starts, err = g.parseDate()
+	case "ends":
+		block.lease.Ends, err = g.parseDate()
+	case "tstp":
+		block.tstp, err = g.parseDate()
+	case "tsfp":
+		block.tsfp, err = g.parseDate()
+	case "atsfp":
+		block.atsfp, err = g.parseDate()
+	case "cltt":
+		block.lease.Cltt, err = g.parseDate()
+	case "binding":
+		block.lease.BindingState, err = g.parseBindingState()
+	case "next":
+		if _, err = g.expect(tokenWord, "binding"); err == nil {
+			block.nextBindingState, err = g.parseBindingState()
+		}
+	case "rewind":
+		if _, err = g.expect(tokenWord, "binding"); err == nil {
+			block.rewindBindingState, err = g.parseBindingState()
+		}
+	case "abandoned":
+		block.lease.BindingState = "abandoned"
+		err = g.expectSemicolon()
+	case "hardware":
+		err = g.parseHardware(block.lease)
+	case "uid":
+		if block.lease.UID, err = g.parseValue(); err == nil {
+			err = g.expectSemicolon()
+		}
+	case "client-hostname":
+		var name token
+		if name, err = g.expect(tokenString, ""); err == nil {
+			block.lease.Name = name.text
+			err = g.expectSemicolon()
+		}
+	case "set":
+		err = g.parseSet(block.lease)
+	case "on":
+		err = g.parseOn(block)
+	default:
+		// option, billing, ddns-text, vendor-class-identifier and friends
+		err = g.skipStatement(tok)
+	}
+	return err
+}
+
+// parseDate reads the date formats dhcpd writes, i.e. `W YYYY/MM/DD HH:MM:SS`
+// in UTC, `epoch N` or `never`, including the terminating semicolon.
+func (g *grammar) parseDate() (time.Time, error) {
+	first, err := g.expect(tokenWord, "")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var date time.Time
+	switch first.text {
+	case "never":
+	case "epoch":
+		secondsTok, err := g.expect(tokenWord, "")
+		if err != nil {
+			return date, err
+		}
+		seconds, err := strconv.ParseInt(secondsTok.text, 10, 64)
+		if err != nil {
+			return date, syntaxError(secondsTok, fmt.Sprintf("invalid epoch: %v", err))
+		}
+		date = time.Unix(seconds, 0).UTC()
+	default:
+		// first is the day of the week, which is implied by the date
+		dayTok, err := g.expect(tokenWord, "")
+		if err != nil {
+			return date, err
+		}
+		timeTok, err := g.expect(tokenWord, "")
+		if err != nil {
+			return date, err
+		}
+		date, err = time.Parse("2006/01/02 15:04:05", dayTok.text+" "+timeTok.text)
+		if err != nil {
+			return date, syntaxError(dayTok, fmt.Sprintf("invalid date: %v", err))
+		}
+	}
+
+	return date, g.expectSemicolon()
+}
+
+func (g *grammar) parseBindingState() (string, error) {
+	if _, err := g.expect(tokenWord, "state"); err != nil {
+		return "", err
+	}
+	state, err := g.expectWord()
+	if err != nil {
+		return "", err
+	}
+	return state, g.expectSemicolon()
+}
+
+func (g *grammar) parseHardware(lease *Lease) error {
+	hwType, err := g.expectWord()
+	if err != nil {
+		return err
+	}
+
+	addrTok, err := g.expect(tokenWord, "")
+	if err != nil {
+		return err
+	}
+
+	addr, err := net.ParseMAC(addrTok.text)
+	if err != nil {
+		// dhcpd omits leading zeros and supports arbitrary lengths
+		if addr, err = parseHex(addrTok.text); err != nil {
+			return syntaxError(addrTok, fmt.Sprintf("invalid hardware address: %v", err))
+		}
+	}
+
+	lease.HardwareType = hwType
+	lease.Hardware = addr
+	return g.expectSemicolon()
+}
+
+func parseHex(s string) ([]byte, error) {
+	parts := strings.Split(s, ":")
+	res := make([]byte, len(parts))
+	for i, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = byte(b)
+	}
+	return res, nil
+}
+
+// parseValue reads a quoted string or a colon separated hex string.
+func (g *grammar) parseValue() (string, error) {
+	tok, err := g.next()
+	if err != nil {
+		return "", err
+	}
+
+	switch tok.kind {
+	case tokenString:
+		return tok.text, nil
+	case tokenWord:
+		if value, err := parseHex(tok.text); err == nil {
+			return string(value), nil
+		}
+		return tok.text, nil
+	}
+	return "", syntaxError(tok, fmt.Sprintf("expected value, got %v", tok))
+}
+
+func (g *grammar) parseSet(lease *Lease) error {
+	name, err := g.expectWord()
+	if err != nil {
+		return err
+	}
+
+	if _, err := g.expect(tokenPunct, "="); err != nil {
+		return err
+	}
+
+	value, err := g.parseValue()
+	if err != nil {
+		return err
+	}
+
+	if lease.Variables == nil {
+		lease.Variables = make(map[string]string)
+	}
+	lease.Variables[name] = value
+	return g.expectSemicolon()
+}
+
+// parseOn reads the event list of an on statement and skips the attached
+// executable statements.
+func (g *grammar) parseOn(block *leaseBlock) error {
+	for {
+		event, err := g.expectWord()
+		if err != nil {
+			return err
+		}
+		block.events = append(block.events, event)
+
+		tok, err := g.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case tok.is(tokenWord, "or"):
+			continue
+		case tok.is(tokenPunct, "{"):
+			return g.skipUntilDepth(g.depth - 1)
+		default:
+			return syntaxError(tok, fmt.Sprintf("expected \"or\" or \"{\", got %v", tok))
+		}
+	}
+}
+
+func (g *grammar) parseFailover() error {
+	if _, err := g.expect(tokenWord, "peer"); err != nil {
+		return err
+	}
+
+	name, err := g.expect(tokenString, "")
+	if err != nil {
+		return err
+	}
+
+	if _, err := g.expect(tokenWord, "state"); err != nil {
+		return err
+	}
+
+	if _, err := g.expect(tokenPunct, "{"); err != nil {
+		return err
+	}
+
+	peer := &failoverPeer{name: name.text}
+	for {
+		tok, err := g.next()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case tok.is(tokenPunct, "}"):
+			g.file.failoverPeers = append(g.file.failoverPeers, peer)
+			return nil
+		case tok.is(tokenWord, "my"):
+			peer.myState, peer.mySince, err = g.parsePeerState()
+		case tok.is(tokenWord, "partner"):
+			peer.partnerState, peer.partnerSince, err = g.parsePeerState()
+		case tok.kind == tokenEOF:
+			err = syntaxError(tok, "unexpected end of file in failover declaration")
+		default:
+			// mclt and other settings
+			err = g.skipStatement(tok)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (g *grammar) parsePeerState() (string, time.Time, error) {
+	if _, err := g.expect(tokenWord, "state"); err != nil {
+		return "", time.Time{}, err
+	}
+
+	state, err := g.expectWord()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if _, err := g.expect(tokenWord, "at"); err != nil {
+		return "", time.Time{}, err
+	}
+
+	since, err := g.parseDate()
+	return state, since, err
+}
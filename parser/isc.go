@@ -0,0 +1,195 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// iscFormat reads the dhcpd.leases(5) format of ISC dhcpd and dhcpd6.
+type iscFormat struct {
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	tails map[string]*tailState
+}
+
+// tailState remembers how far a lease file has been parsed. dhcpd only
+// appends to its lease file until it writes a new one and renames it over
+// the old file.
+type tailState struct {
+	file   os.FileInfo
+	offset int64
+	// anchor holds the bytes before offset to detect rewrites in place
+	anchor []byte
+	leases *leaseSet
+	// skipped holds the error of the first declaration that has been
+	// skipped. The address of a skipped declaration is unknown, so the
+	// leases stay incomplete until dhcpd rewrites the file, which it does
+	// about once an hour.
+	skipped error
+}
+
+const anchorSize = 256
+
+// parse calls handler for every address in data whose authoritative lease
+// declaration has a hostname. Syntax errors in single declarations
+// are logged and skipped, the first one is returned once the handler has
+// been called.
+func (f *iscFormat) parse(ctx context.Context, data []byte, handler func(*Lease)) error {
+	// dhcpd appends a new declaration whenever a lease changes, so the last
+	// declaration of an address is authoritative
+	leases := newLeaseSet()
+
+	_, skipped, parseErr := f.consume(ctx, data, leases)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := leases.each(ctx, handler); err != nil {
+		return err
+	}
+	if parseErr == nil && skipped != nil {
+		return skippedError(skipped)
+	}
+	return parseErr
+}
+
+func skippedError(err error) error {
+	return fmt.Errorf("skipped unparsable declaration: %w", err)
+}
+
+// consume adds the leases in data to leases and returns the number of bytes
+// that hold complete declarations. Invalid declarations are skipped and the
+// error of the first one is returned as skipped, a declaration cut off by the
+// end of data stops parsing with an error.
+func (f *iscFormat) consume(ctx context.Context, data []byte, leases *leaseSet) (consumed int, skipped error, err error) {
+	g := newGrammar(data)
+
+	count := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return g.consumed, skipped, err
+		}
+
+		block, err := g.nextLease()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && g.truncated(err) {
+			f.logger.Debug("incomplete declaration at end of data", zap.Error(err))
+			return g.consumed, skipped, err
+		}
+		if err != nil {
+			f.logger.Warn("skipping unparsable declaration", zap.Error(err))
+			if skipped == nil {
+				skipped = err
+			}
+			continue
+		}
+
+		count += 1
+		leases.add(block.lease)
+	}
+
+	f.logger.Debug("parsed lease declarations", zap.Int("count", count), zap.Int("addresses", leases.len()),
+		zap.String("authoring-byte-order", g.file.authoringByteOrder),
+		zap.Int("failover-peers", len(g.file.failoverPeers)))
+	return g.consumed, skipped, nil
+}
+
+// tail parses only the declarations appended to the file at path since the
+// previous call and calls handler for all leases of the file. The whole file
+// is parsed again if it has been replaced or truncated. An incomplete
+// declaration at the end of the file is left for the next call, whereas a
+// skipped declaration is returned as error once the handler has been called,
+// until the file is rewritten.
+func (f *iscFormat) tail(ctx context.Context, path string, handler func(*Lease)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	state := f.tails[path]
+	if state != nil && !state.appended(file, info) {
+		f.logger.Info("lease file has been rewritten, parsing whole file", zap.String("path", path))
+		state = nil
+	}
+	if state == nil {
+		state = &tailState{leases: newLeaseSet()}
+	}
+
+	if _, err := file.Seek(state.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	consumed, skipped, err := f.consume(ctx, data, state.leases)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// the state is incomplete, start over on the next call
+		delete(f.tails, path)
+		return ctxErr
+	}
+	if err != nil {
+		f.logger.Debug("stopped at incomplete data", zap.Error(err), zap.String("path", path))
+	}
+	if skipped != nil && state.skipped == nil {
+		state.skipped = skippedError(skipped)
+	} else if state.skipped != nil {
+		f.logger.Warn("leases are incomplete until the lease file is rewritten", zap.String("path", path),
+			zap.Error(state.skipped))
+	}
+
+	f.logger.Debug("parsed appended data", zap.String("path", path),
+		zap.Int64("offset", state.offset), zap.Int("consumed", consumed), zap.Int("read", len(data)))
+
+	state.file = info
+	state.offset += int64(consumed)
+	state.anchor = append(state.anchor, data[:consumed]...)
+	if len(state.anchor) > anchorSize {
+		state.anchor = state.anchor[len(state.anchor)-anchorSize:]
+	}
+
+	if f.tails == nil {
+		f.tails = make(map[string]*tailState)
+	}
+	f.tails[path] = state
+
+	if err := state.leases.each(ctx, handler); err != nil {
+		return err
+	}
+	return state.skipped
+}
+
+// appended reports whether file is the file that has been parsed before
+// and has only been appended to since.
+func (s *tailState) appended(file *os.File, info os.FileInfo) bool {
+	if !os.SameFile(s.file, info) || info.Size() < s.offset {
+		return false
+	}
+
+	anchor := make([]byte, len(s.anchor))
+	if _, err := file.ReadAt(anchor, s.offset-int64(len(anchor))); err != nil {
+		return false
+	}
+	return bytes.Equal(anchor, s.anchor)
+}
@@ -0,0 +1,202 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"inet.af/netaddr"
+)
+
+// keaFormat reads the CSV lease files of the Kea memfile backend, i.e.
+// kea-leases4.csv and kea-leases6.csv. Kea appends a line whenever a lease
+// changes, so like dhcpd the last line of an address is authoritative.
+type keaFormat struct {
+	logger *zap.Logger
+}
+
+// keaStates maps the state column to binding states. Declined addresses have
+// no equivalent in dhcpd and keep the name Kea uses.
+var keaStates = map[string]string{
+	"0": "active",
+	"1": "declined",
+	"2": "expired",
+	"3": "released",
+}
+
+const keaInfiniteLifetime = math.MaxUint32
+
+// readFile reads the lease file together with the files of an interrupted
+// or running lease file cleanup in the order Kea itself loads them.
+func (f *keaFormat) readFile(path string) ([]byte, error) {
+	paths := []string{path + ".completed"}
+	if _, err := os.Stat(paths[0]); errors.Is(err, fs.ErrNotExist) {
+		paths = []string{path + ".2", path + ".1"}
+	}
+
+	var data []byte
+	for _, rotated := range paths {
+		content, err := ioutil.ReadFile(rotated)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, content...)
+		data = append(data, '\n')
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, content...), nil
+}
+
+func (f *keaFormat) parse(ctx context.Context, data []byte, handler func(*Lease)) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+
+	leases := newLeaseSet()
+
+	var columns map[string]int
+	count := 0
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		// every file starts with a header, the rotated files included
+		if fields[0] == "address" {
+			columns = make(map[string]int, len(fields))
+			for i, name := range fields {
+				columns[name] = i
+			}
+			continue
+		}
+
+		if columns == nil {
+			f.logger.Warn("skipping lease before csv header", zap.Int("line", lineNumber))
+			continue
+		}
+
+		lease, err := parseKeaRecord(columns, fields)
+		if err != nil {
+			f.logger.Warn("skipping unparsable lease", zap.Int("line", lineNumber), zap.Error(err))
+			continue
+		}
+
+		count += 1
+		leases.add(lease)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.logger.Debug("parsed kea leases", zap.Int("count", count), zap.Int("addresses", leases.len()))
+	return leases.each(ctx, handler)
+}
+
+type keaRecord struct {
+	columns map[string]int
+	fields  []string
+}
+
+// get returns the unescaped value of a column or an empty string if the file
+// does not have the column.
+func (r keaRecord) get(name string) string {
+	i, ok := r.columns[name]
+	if !ok || i >= len(r.fields) {
+		return ""
+	}
+	return strings.ReplaceAll(r.fields[i], "&#x2c", ",")
+}
+
+func parseKeaRecord(columns map[string]int, fields []string) (*Lease, error) {
+	record := keaRecord{columns: columns, fields: fields}
+
+	address, err := netaddr.ParseIP(record.get("address"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid address: %v", ErrSyntax, err)
+	}
+
+	lease := &Lease{Address: address}
+
+	state, ok := keaStates[record.get("state")]
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid state %q", ErrSyntax, record.get("state"))
+	}
+	lease.BindingState = state
+
+	lifetime, err := strconv.ParseUint(record.get("valid_lifetime"), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid valid_lifetime: %v", ErrSyntax, err)
+	}
+
+	expire, err := strconv.ParseInt(record.get("expire"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid expire: %v", ErrSyntax, err)
+	}
+
+	lease.Cltt = time.Unix(expire-int64(lifetime), 0).UTC()
+	if lifetime != keaInfiniteLifetime {
+		lease.Ends = time.Unix(expire, 0).UTC()
+	}
+
+	if hostname := strings.TrimSuffix(record.get("hostname"), "."); hostname != "" {
+		lease.Name = hostLabel(hostname)
+	}
+
+	if hwaddr := record.get("hwaddr"); hwaddr != "" {
+		if lease.Hardware, err = parseHex(hwaddr); err != nil {
+			return nil, fmt.Errorf("%w: invalid hwaddr: %v", ErrSyntax, err)
+		}
+		lease.HardwareType = "ethernet"
+		if hwtype := record.get("hwtype"); hwtype != "" && hwtype != "1" {
+			if arpType, err := strconv.ParseUint(hwtype, 10, 16); err == nil && arpHardwareTypes[arpType] != "" {
+				lease.HardwareType = arpHardwareTypes[arpType]
+			} else {
+				lease.HardwareType = hwtype
+			}
+		}
+	}
+
+	// client_id for DHCPv4 and duid for DHCPv6
+	for _, column := range []string{"client_id", "duid"} {
+		if id := record.get(column); id != "" {
+			if value, err := parseHex(id); err == nil {
+				lease.UID = string(value)
+			}
+		}
+	}
+
+	// lease_type 2 is a prefix delegation
+	if record.get("lease_type") == "2" {
+		bits, err := strconv.ParseUint(record.get("prefix_len"), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid prefix_len: %v", ErrSyntax, err)
+		}
+		if lease.Prefix, err = address.Prefix(uint8(bits)); err != nil {
+			return nil, fmt.Errorf("%w: invalid prefix: %v", ErrSyntax, err)
+		}
+	}
+
+	return lease, nil
+}
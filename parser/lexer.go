@@ -0,0 +1,199 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenPunct
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of file"
+	case tokenWord:
+		return "word"
+	case tokenString:
+		return "string"
+	case tokenPunct:
+		return "punctuation"
+	}
+	return "unknown"
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	// offset is the byte offset of the first character after the token
+	offset int
+	line   int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return t.kind.String()
+	}
+	return fmt.Sprintf("%v %q", t.kind, t.text)
+}
+
+// lexer splits the dhcpd.leases(5) format into words, quoted strings and
+// punctuation. Comments and whitespace are skipped.
+type lexer struct {
+	data []byte
+	pos  int
+	line int
+}
+
+func newLexer(data []byte) *lexer {
+	return &lexer{data: data, line: 1}
+}
+
+const punctuation = "{};=,()"
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipSpace()
+
+	if l.pos >= len(l.data) {
+		return token{kind: tokenEOF, offset: l.pos, line: l.line}, nil
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '"':
+		return l.readString()
+	case strings.IndexByte(punctuation, c) >= 0:
+		l.pos++
+		return token{kind: tokenPunct, text: string(c), offset: l.pos, line: l.line}, nil
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isSpace(c) || c == '"' || c == '#' || strings.IndexByte(punctuation, c) >= 0 {
+			break
+		}
+		l.pos++
+	}
+	return token{kind: tokenWord, text: string(l.data[start:l.pos]), offset: l.pos, line: l.line}, nil
+}
+
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case isSpace(c):
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) readString() (token, error) {
+	line := l.line
+	// skip opening quote
+	l.pos++
+
+	var sb strings.Builder
+	var escapeErr error
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+
+		switch c {
+		case '"':
+			if escapeErr != nil {
+				return token{}, escapeErr
+			}
+			return token{kind: tokenString, text: sb.String(), offset: l.pos, line: line}, nil
+		case '\n':
+			l.line++
+			sb.WriteByte(c)
+		case '\\':
+			// an invalid escape sequence is reported after the closing quote,
+			// so that the lexer can continue after the string
+			if err := l.readEscape(&sb); err != nil && escapeErr == nil {
+				escapeErr = fmt.Errorf("line %d: %w", l.line, err)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return token{}, fmt.Errorf("line %d: %w", line, ErrUnterminatedString)
+}
+
+func (l *lexer) readEscape(sb *strings.Builder) error {
+	if l.pos >= len(l.data) {
+		return ErrUnterminatedString
+	}
+
+	c := l.data[l.pos]
+	l.pos++
+
+	switch {
+	case c == 'n':
+		sb.WriteByte('\n')
+	case c == 't':
+		sb.WriteByte('\t')
+	case c == 'r':
+		sb.WriteByte('\r')
+	case c == 'b':
+		sb.WriteByte('\b')
+	case c == 'x':
+		return l.readNumericEscape(sb, 16, 2)
+	case c >= '0' && c <= '7':
+		l.pos--
+		return l.readNumericEscape(sb, 8, 3)
+	default:
+		sb.WriteByte(c)
+	}
+	return nil
+}
+
+func (l *lexer) readNumericEscape(sb *strings.Builder, base int, maxDigits int) error {
+	start := l.pos
+	for l.pos < len(l.data) && l.pos-start < maxDigits && isDigit(l.data[l.pos], base) {
+		l.pos++
+	}
+
+	value, err := strconv.ParseUint(string(l.data[start:l.pos]), base, 8)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEscape, err)
+	}
+	sb.WriteByte(byte(value))
+	return nil
+}
+
+func isDigit(c byte, base int) bool {
+	switch base {
+	case 8:
+		return c >= '0' && c <= '7'
+	case 16:
+		return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+	}
+	return c >= '0' && c <= '9'
+}
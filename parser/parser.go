@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"regexp"
+	"net"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"inet.af/netaddr"
@@ -13,6 +15,23 @@ import (
 type Lease struct {
 	Name    string
 	Address netaddr.IP
+	// BindingState is the dhcpd binding state, e.g. active, free or backup
+	BindingState string
+
+	// Prefix is the delegated prefix of DHCPv6 prefix delegations
+	Prefix netaddr.IPPrefix
+
+	// Starts, Ends and Cltt are zero if not present or never
+	Starts time.Time
+	Ends   time.Time
+	// Cltt is the client's last transaction time
+	Cltt time.Time
+
+	HardwareType string
+	Hardware     net.HardwareAddr
+	UID          string
+	// Variables holds the values of set statements, e.g. ddns-fwd-name
+	Variables map[string]string
 }
 
 func (l *Lease) GetName() string {
@@ -23,22 +42,144 @@ func (l *Lease) GetAddress() netaddr.IP {
 	return l.Address
 }
 
+func (l *Lease) GetEnds() time.Time {
+	return l.Ends
+}
+
+// IsPrefix reports whether the lease delegates a prefix instead of assigning
+// a single address.
+func (l *Lease) IsPrefix() bool {
+	return l.Prefix.IsValid()
+}
+
+// Ended reports whether the lease has an end time before now.
+func (l *Lease) Ended(now time.Time) bool {
+	return !l.Ends.IsZero() && l.Ends.Before(now)
+}
+
+// InState reports whether the binding state of the lease is one of states.
+func (l *Lease) InState(states []string) bool {
+	for _, state := range states {
+		if l.BindingState == state {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseSet keeps the last lease of every address in order of the first
+// appearance of the address.
+type leaseSet struct {
+	leases  []*Lease
+	indices map[netaddr.IP]int
+}
+
+func newLeaseSet() *leaseSet {
+	return &leaseSet{indices: make(map[netaddr.IP]int)}
+}
+
+func (s *leaseSet) add(lease *Lease) {
+	if i, ok := s.indices[lease.Address]; ok {
+		s.leases[i] = lease
+		return
+	}
+	s.indices[lease.Address] = len(s.leases)
+	s.leases = append(s.leases, lease)
+}
+
+func (s *leaseSet) len() int {
+	return len(s.leases)
+}
+
+// each calls handler for every lease that has a hostname.
+func (s *leaseSet) each(ctx context.Context, handler func(*Lease)) error {
+	for _, lease := range s.leases {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if lease.Name == "" {
+			continue
+		}
+		handler(lease)
+	}
+	return nil
+}
+
+// hostLabel returns the first label of a possibly fully qualified name.
+func hostLabel(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
+
 func (l *Lease) String() string {
 	return fmt.Sprintf("%v (%v)", l.Name, l.Address)
 }
 
+// format parses the content of a lease file of a specific format.
+type format interface {
+	// parse calls handler for every lease in data that has a hostname
+	parse(ctx context.Context, data []byte, handler func(*Lease)) error
+}
+
+// fileReader is implemented by formats that spread their leases across
+// several files.
+type fileReader interface {
+	readFile(path string) ([]byte, error)
+}
+
+// tailer is implemented by formats that continue parsing a file where the
+// previous call stopped.
+type tailer interface {
+	tail(ctx context.Context, path string, handler func(*Lease)) error
+}
+
 type parser struct {
 	logger *zap.Logger
+	format format
 }
 
+const (
+	FormatDhcpd   = "dhcpd"
+	FormatDnsmasq = "dnsmasq"
+	FormatKea     = "kea"
+)
+
+// NewParser returns a parser for ISC dhcpd lease files.
 func NewParser(logger *zap.Logger) *parser {
-	return &parser{logger: logger}
+	return &parser{logger: logger, format: &iscFormat{logger: logger}}
+}
+
+// NewDnsmasqParser returns a parser for dnsmasq lease files.
+func NewDnsmasqParser(logger *zap.Logger) *parser {
+	return &parser{logger: logger, format: &dnsmasqFormat{logger: logger}}
+}
+
+// NewKeaParser returns a parser for Kea memfile CSV lease files.
+func NewKeaParser(logger *zap.Logger) *parser {
+	return &parser{logger: logger, format: &keaFormat{logger: logger}}
 }
 
-var leaseMatcher = regexp.MustCompile(`lease ([0-9a-f.:]+) {(?:[^}]|}[^\n]+")+client-hostname "([^"]+)";`)
+// NewFormatParser returns a parser for the named lease file format.
+func NewFormatParser(format string, logger *zap.Logger) (*parser, error) {
+	switch format {
+	case FormatDhcpd, "":
+		return NewParser(logger), nil
+	case FormatDnsmasq:
+		return NewDnsmasqParser(logger), nil
+	case FormatKea:
+		return NewKeaParser(logger), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+}
+
+func (p *parser) readFile(path string) ([]byte, error) {
+	if reader, ok := p.format.(fileReader); ok {
+		return reader.readFile(path)
+	}
+	return ioutil.ReadFile(path)
+}
 
 func (p *parser) ParseFile(path string) ([]*Lease, error) {
-	content, err := ioutil.ReadFile(path)
+	content, err := p.readFile(path)
 	if err != nil {
 		return []*Lease{}, err
 	}
@@ -46,22 +187,13 @@ func (p *parser) ParseFile(path string) ([]*Lease, error) {
 }
 
 func (p *parser) ParseData(data string) ([]*Lease, error) {
-	matches := leaseMatcher.FindAllStringSubmatch(data, -1)
-
-	p.logger.Debug("matched file", zap.Int("count", len(matches)))
-
 	leases := []*Lease{}
-	for imatch := range matches {
-		lease, err := parseMatch(matches[imatch])
-		if err != nil {
-			p.logger.Warn("unparsable lease match", zap.Error(err), zap.Strings("match", matches[imatch]))
-			continue
-		}
+	err := p.format.parse(context.Background(), []byte(data), func(lease *Lease) {
 		leases = append(leases, lease)
-	}
+	})
 
-	p.logger.Debug("parsed leases", zap.Int("count", len(leases)), zap.Int("matches", len(matches)))
-	return leases, nil
+	p.logger.Debug("parsed leases", zap.Int("count", len(leases)))
+	return leases, err
 }
 
 func (p *parser) ParseStreaming(ctx context.Context, path string) chan *Lease {
@@ -73,42 +205,41 @@ func (p *parser) ParseStreaming(ctx context.Context, path string) chan *Lease {
 
 		defer close(ch)
 
-		content, err := ioutil.ReadFile(path)
+		err := p.parsePath(parseCtx, path, func(lease *Lease) {
+			select {
+			case ch <- lease:
+			case <-parseCtx.Done():
+			}
+		})
 		if err != nil {
-			p.logger.Error("failed to open file", zap.Error(err), zap.String("path", path))
-			return
+			p.logger.Error("failed to parse file", zap.Error(err), zap.String("path", path))
 		}
+	}()
+	return ch
+}
 
-		count := 0
-		searchIndex := 0
-		for {
-			if parseCtx.Err() != nil {
-				p.logger.Error("stopped parsing", zap.Error(err))
-				return
-			}
-
-			match := leaseMatcher.FindSubmatchIndex(content[searchIndex:])
-			if match == nil {
-				p.logger.Debug("no more matches in file", zap.String("path", path), zap.Int("count", count))
-				break
-			}
+// ParseAll returns the leases of the file at path. Unlike ParseStreaming it
+// reports whether the leases are complete, the leases read before an error
+// are returned together with it.
+func (p *parser) ParseAll(ctx context.Context, path string) ([]*Lease, error) {
+	leases := []*Lease{}
+	err := p.parsePath(ctx, path, func(lease *Lease) {
+		leases = append(leases, lease)
+	})
+	return leases, err
+}
 
-			matchedBytes := make([][]byte, len(match)/2)
-			for i := 0; i < len(matchedBytes); i++ {
-				matchedBytes[i] = content[searchIndex+match[i*2] : searchIndex+match[i*2+1]]
-			}
+func (p *parser) parsePath(ctx context.Context, path string, handler func(*Lease)) error {
+	if t, ok := p.format.(tailer); ok {
+		return t.tail(ctx, path, handler)
+	}
 
-			if lease, err := parseMatchBytes(matchedBytes); err == nil {
-				ch <- lease
-			} else {
-				p.logger.Warn("failed to parse match", zap.Error(err), zap.ByteStrings("match", matchedBytes))
-			}
+	content, err := p.readFile(path)
+	if err != nil {
+		return err
+	}
 
-			searchIndex += match[1]
-			count += 1
-		}
-	}()
-	return ch
+	return p.format.parse(ctx, content, handler)
 }
 
 type MatchHandler func(*Lease)
@@ -137,31 +268,13 @@ func (p *parser) ParseStreamingWithHandler(ctx context.Context, path string, han
 	}
 }
 
-func parseMatchBytes(match [][]byte) (*Lease, error) {
-	strs := make([]string, len(match))
-	for i := range match {
-		strs[i] = string(match[i])
-	}
-	return parseMatch(strs)
-}
-
-func parseMatch(match []string) (*Lease, error) {
-	if len(match) != 3 {
-		return nil, ErrInvalidGroupCount
-	}
-
-	address, err := netaddr.ParseIP(match[1])
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse address: %w", err)
-	}
-
-	return &Lease{Name: match[2], Address: address}, nil
-}
-
 type Error string
 
 func (e Error) Error() string { return string(e) }
 
 const (
-	ErrInvalidGroupCount = Error("match has invalid length")
+	ErrSyntax             = Error("syntax error")
+	ErrUnterminatedString = Error("unterminated string")
+	ErrInvalidEscape      = Error("invalid escape sequence")
+	ErrUnknownFormat      = Error("unknown lease file format")
 )
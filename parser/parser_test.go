@@ -2,6 +2,9 @@ package parser_test
 
 import (
 	"context"
+	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -32,6 +35,14 @@ var expectation = []*parser.Lease{
 	{Name: "diz-dev-worker-7gcpvv-8555586f6d-zdms9", Address: netaddr.MustParseIP("10.90.36.189")},
 }
 
+func nameAddresses(leases []*parser.Lease) []string {
+	s := make([]string, len(leases))
+	for i := range leases {
+		s[i] = leases[i].String()
+	}
+	return s
+}
+
 func TestParsing(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 	testParser := parser.NewParser(logger)
@@ -41,7 +52,7 @@ func TestParsing(t *testing.T) {
 	}
 
 	assert.Len(t, leases, len(expectation), "expect lease list length to match")
-	assert.ElementsMatch(t, leases, expectation, "expect parsed leases to match")
+	assert.ElementsMatch(t, nameAddresses(leases), nameAddresses(expectation), "expect parsed leases to match")
 }
 
 func TestStreamingParse(t *testing.T) {
@@ -73,7 +84,7 @@ func TestStreamingParse(t *testing.T) {
 
 	assert.NoError(t, ctx.Err(), "expect context to not time out")
 	assert.Len(t, leases, len(expectation), "expect lease list length to match")
-	assert.ElementsMatch(t, leases, expectation, "expect parsed leases to match")
+	assert.ElementsMatch(t, nameAddresses(leases), nameAddresses(expectation), "expect parsed leases to match")
 }
 
 func TestStreamingParseWithHandler(t *testing.T) {
@@ -101,3 +112,324 @@ func TestStreamingParseWithHandler(t *testing.T) {
 		t.Error("context timed out")
 	}
 }
+
+const grammarExample = `
+# comment with a { brace
+authoring-byte-order little-endian;
+server-duid "\000\001\000\001*";
+
+failover peer "internal-dhcp" state {
+  my state normal at 3 2022/09/21 08:39:41;
+  partner state communications-interrupted at epoch 1663749593;
+  mclt 3600;
+}
+
+lease 10.0.0.1 {
+  starts 3 2022/09/21 08:17:54;
+  ends never;
+  cltt epoch 1663748274; # Wed Sep 21 08:17:54 2022
+  binding state active;
+  next binding state free;
+  rewind binding state free;
+  hardware ethernet 0:50:56:af:d8:17;
+  uid "\377}\"{\032";
+  set ddns-fwd-name = "host-a.example.com";
+  set vendor-class-identifier = "MSFT 5.0";
+  on commit or expiry {
+    set foo = "}";
+    if exists agent.circuit-id { log (info, "commit"); }
+  }
+  option agent.circuit-id 0:1:2;
+  client-hostname "host-a";
+}
+
+host static-host {
+  dynamic;
+  hardware ethernet 00:50:56:af:d8:18;
+  fixed-address 10.0.0.99;
+}
+
+lease 10.0.0.2 {
+  client-hostname "host-b";
+  uid 01:00:50:56:af:d8:19;
+  binding state free;
+}
+
+lease 10.0.0.3 {
+  starts 3 2022/13/41 08:17:54;
+  client-hostname "broken";
+}
+
+lease 2001:db8::4 {
+  client-hostname "host}c";
+}
+`
+
+func collect(ctx context.Context, ch chan *parser.Lease) []*parser.Lease {
+	leases := []*parser.Lease{}
+	for {
+		select {
+		case lease, ok := <-ch:
+			if !ok {
+				return leases
+			}
+			leases = append(leases, lease)
+		case <-ctx.Done():
+			return leases
+		}
+	}
+}
+
+func TestStreamingParseTail(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser := parser.NewParser(logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dhcpd.leases")
+
+	leaseFile, err := os.Create(path)
+	assert.NoError(t, err)
+	defer leaseFile.Close()
+
+	write := func(data string) {
+		_, err := leaseFile.WriteString(data)
+		assert.NoError(t, err)
+	}
+
+	write("lease 10.0.0.1 {\n  client-hostname \"a\";\n}\nlease 10.0.0.2 {\n  client-hostname \"b")
+	leases := collect(ctx, testParser.ParseStreaming(ctx, path))
+	assert.Equal(t, []string{"a (10.0.0.1)"}, nameAddresses(leases), "expect incomplete declaration to be ignored")
+
+	write("\";\n}\nlease 10.0.0.1 {\n  client-hostname \"c\";\n}\n")
+	leases = collect(ctx, testParser.ParseStreaming(ctx, path))
+	assert.Equal(t, []string{"c (10.0.0.1)", "b (10.0.0.2)"}, nameAddresses(leases), "expect appended declarations to be parsed")
+
+	// dhcpd writes a new file and renames it over the old one
+	rotated := filepath.Join(dir, "dhcpd.leases~")
+	assert.NoError(t, os.WriteFile(rotated, []byte("lease 10.0.0.3 {\n  client-hostname \"d\";\n}\n"), 0644))
+	assert.NoError(t, os.Rename(rotated, path))
+
+	leases = collect(ctx, testParser.ParseStreaming(ctx, path))
+	assert.Equal(t, []string{"d (10.0.0.3)"}, nameAddresses(leases), "expect replaced file to be parsed again")
+
+	assert.NoError(t, os.Truncate(path, 0))
+	leases = collect(ctx, testParser.ParseStreaming(ctx, path))
+	assert.Empty(t, leases, "expect truncated file to be parsed again")
+
+	assert.NoError(t, ctx.Err(), "expect context to not time out")
+}
+
+func TestParseAllIncomplete(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser := parser.NewParser(logger)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	data := "lease 10.0.0.1 {\n  client-hostname \"a\";\n}\nlease 10.0.0.2 {\n  client-hostname \"b"
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	leases, err := testParser.ParseAll(ctx, path)
+	assert.NoError(t, err, "expect a declaration that is still being written to be left for later")
+	assert.Equal(t, []string{"a (10.0.0.1)"}, nameAddresses(leases))
+
+	assert.NoError(t, os.WriteFile(path, []byte(data+"\";\n}\n"), 0644))
+	leases, err = testParser.ParseAll(ctx, path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a (10.0.0.1)", "b (10.0.0.2)"}, nameAddresses(leases))
+}
+
+func TestStreamingParseTailSkipsInvalid(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser := parser.NewParser(logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	leaseFile, err := os.Create(path)
+	assert.NoError(t, err)
+	defer leaseFile.Close()
+
+	write := func(data string) {
+		_, err := leaseFile.WriteString(data)
+		assert.NoError(t, err)
+	}
+
+	write("lease 10.0.0.1 {\n  client-hostname \"a\";\n}\nlease 10.0.0.2 {\n  uid \"\\x\";\n  client-hostname \"b\";\n}\n")
+	write("lease 10.0.0.3 {\n  client-hostname \"c\";\n}\n")
+	leases := collect(ctx, testParser.ParseStreaming(ctx, path))
+	assert.Equal(t, []string{"a (10.0.0.1)", "c (10.0.0.3)"}, nameAddresses(leases), "expect invalid declaration to be skipped")
+
+	write("lease 10.0.0.4 {\n  client-hostname \"d\";\n}\n")
+	leases = collect(ctx, testParser.ParseStreaming(ctx, path))
+	assert.Equal(t, []string{"a (10.0.0.1)", "c (10.0.0.3)", "d (10.0.0.4)"}, nameAddresses(leases),
+		"expect declarations appended after an invalid declaration to be parsed")
+
+	leases, err = testParser.ParseAll(ctx, path)
+	assert.ErrorIs(t, err, parser.ErrInvalidEscape, "expect skipped declaration to make the leases incomplete")
+	assert.Equal(t, []string{"a (10.0.0.1)", "c (10.0.0.3)", "d (10.0.0.4)"}, nameAddresses(leases))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	leases, err = testParser.ParseData(string(data))
+	assert.ErrorIs(t, err, parser.ErrInvalidEscape, "expect ParseData to report the skipped declaration as well")
+	assert.Equal(t, []string{"a (10.0.0.1)", "c (10.0.0.3)", "d (10.0.0.4)"}, nameAddresses(leases))
+
+	assert.NoError(t, ctx.Err(), "expect context to not time out")
+}
+
+func TestParseGrammar(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser := parser.NewParser(logger)
+
+	leases, err := testParser.ParseData(grammarExample)
+	assert.ErrorIs(t, err, parser.ErrSyntax, "expect the declaration with an invalid date to be reported")
+
+	assert.Equal(t, []string{"host-a (10.0.0.1)", "host-b (10.0.0.2)", "host}c (2001:db8::4)"}, nameAddresses(leases))
+
+	hostA := leases[0]
+	assert.Equal(t, "active", hostA.BindingState)
+	assert.Equal(t, time.Date(2022, 9, 21, 8, 17, 54, 0, time.UTC), hostA.Starts)
+	assert.True(t, hostA.Ends.IsZero(), "expect ends never to be zero")
+	assert.Equal(t, time.Unix(1663748274, 0).UTC(), hostA.Cltt)
+	assert.False(t, hostA.Ended(time.Now()))
+	assert.Equal(t, "ethernet", hostA.HardwareType)
+	assert.Equal(t, "00:50:56:af:d8:17", hostA.Hardware.String())
+	assert.Equal(t, "\377}\"{\032", hostA.UID)
+	assert.Equal(t, map[string]string{
+		"ddns-fwd-name":           "host-a.example.com",
+		"vendor-class-identifier": "MSFT 5.0",
+	}, hostA.Variables)
+
+	assert.Equal(t, "\x01\x00\x50\x56\xaf\xd8\x19", leases[1].UID)
+	assert.Equal(t, "free", leases[1].BindingState)
+	assert.False(t, leases[1].InState([]string{"active", "backup"}))
+}
+
+func TestParseLastDeclarationWins(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser := parser.NewParser(logger)
+
+	leases, err := testParser.ParseData(`
+lease 10.0.0.1 { client-hostname "old"; binding state active; }
+lease 10.0.0.2 { client-hostname "released"; binding state active; }
+lease 10.0.0.3 { client-hostname "other"; binding state active; }
+lease 10.0.0.1 { client-hostname "new"; binding state active; }
+lease 10.0.0.2 { binding state free; }
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new (10.0.0.1)", "other (10.0.0.3)"}, nameAddresses(leases))
+}
+
+func TestParseV6(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser := parser.NewParser(logger)
+
+	leases, err := testParser.ParseFile("testdata/leases6.example")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"tzdim-dachstein (2001:db8:90::1a)",
+		"tzdim-marmolata (2001:db8:90::2b)",
+		"tzdim-marmolata (2001:db8:90::2c)",
+		"k8s-master-worker-64bf8b486f-frgks (2001:db8:90::3c)",
+		"edge-router (2001:db8:9100::)",
+	}, nameAddresses(leases))
+
+	dachstein := leases[0]
+	assert.Equal(t, "active", dachstein.BindingState)
+	assert.Equal(t, time.Date(2022, 9, 21, 21, 17, 54, 0, time.UTC), dachstein.Ends)
+	assert.Equal(t, time.Date(2022, 9, 21, 9, 17, 54, 0, time.UTC), dachstein.Cltt)
+	assert.False(t, dachstein.IsPrefix())
+
+	assert.Equal(t, "expired", leases[2].BindingState)
+
+	router := leases[4]
+	assert.True(t, router.IsPrefix())
+	assert.Equal(t, "2001:db8:9100::/56", router.Prefix.String())
+}
+
+func TestParseDnsmasq(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser, err := parser.NewFormatParser(parser.FormatDnsmasq, logger)
+	assert.NoError(t, err)
+
+	leases, err := testParser.ParseFile("testdata/dnsmasq.leases")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"unz-hans-lab-default-6898b454f4-h4xkk (10.90.36.86)",
+		"tzdim-dev-default-647ff57c9b-8vf78 (10.90.36.113)",
+		"tzdim-dachstein (10.90.36.105)",
+		"ib-node (10.90.36.120)",
+		"tzdim-dachstein (2001:db8:90::1a)",
+		"k8s-master-worker-64bf8b486f-frgks (2001:db8:90::3c)",
+	}, nameAddresses(leases))
+
+	first := leases[0]
+	assert.Equal(t, "active", first.BindingState)
+	assert.Equal(t, time.Unix(1663748274, 0).UTC(), first.Ends)
+	assert.Equal(t, "ethernet", first.HardwareType)
+	assert.Equal(t, "00:50:56:af:d8:17", first.Hardware.String())
+	assert.Equal(t, "\x01\x00\x50\x56\xaf\xd8\x17", first.UID)
+
+	assert.True(t, leases[2].Ends.IsZero(), "expect expiry 0 to never end")
+	assert.Equal(t, "infiniband", leases[3].HardwareType)
+	assert.Nil(t, leases[4].Hardware)
+
+	_, err = parser.NewFormatParser("unknown", logger)
+	assert.ErrorIs(t, err, parser.ErrUnknownFormat)
+}
+
+func TestParseKea(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser, err := parser.NewFormatParser(parser.FormatKea, logger)
+	assert.NoError(t, err)
+
+	leases, err := testParser.ParseFile("testdata/kea-leases4.csv")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"unz-hans-lab-default-6898b454f4-h4xkk (10.90.36.86)",
+		"tzdim-dev-default-647ff57c9b-8vf78 (10.90.36.113)",
+		"tzdim-dachstein (10.90.36.105)",
+		"tzdim-dev-default-647ff57c9b-tq2gl (10.90.36.117)",
+	}, nameAddresses(leases))
+
+	released := leases[0]
+	assert.Equal(t, "released", released.BindingState)
+	assert.Equal(t, time.Unix(1663748300, 0).UTC(), released.Ends)
+
+	renewed := leases[1]
+	assert.Equal(t, "active", renewed.BindingState)
+	assert.Equal(t, time.Unix(1663748400, 0).UTC(), renewed.Ends)
+	assert.Equal(t, time.Unix(1663744800, 0).UTC(), renewed.Cltt)
+	assert.Equal(t, "00:50:56:af:40:63", renewed.Hardware.String())
+
+	assert.True(t, leases[2].Ends.IsZero(), "expect infinite lifetime to never end")
+	assert.Equal(t, "declined", leases[3].BindingState)
+
+	leases, err = testParser.ParseFile("testdata/kea-leases6.csv")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"tzdim-dachstein (2001:db8:90::1a)",
+		"k8s-master-worker-64bf8b486f-frgks (2001:db8:90::3c)",
+		"edge-router (2001:db8:9100::)",
+	}, nameAddresses(leases))
+	assert.Equal(t, "00:01:00:01:2a:bd:90:11:00:50:56:af:a4:d5", net.HardwareAddr(leases[0].UID).String())
+	assert.True(t, leases[2].IsPrefix())
+	assert.Equal(t, "2001:db8:9100::/56", leases[2].Prefix.String())
+}
+
+func TestParseUnterminated(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	testParser := parser.NewParser(logger)
+
+	leases, err := testParser.ParseData("lease 10.0.0.1 {\n  client-hostname \"a\";\n}\nlease 10.0.0.2 {\n  uid \"abc")
+	assert.ErrorIs(t, err, parser.ErrUnterminatedString)
+	assert.Equal(t, []string{"a (10.0.0.1)"}, nameAddresses(leases))
+}
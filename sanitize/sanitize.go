@@ -0,0 +1,211 @@
+package sanitize
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"go.uber.org/zap"
+	"golang.org/x/net/idna"
+)
+
+const (
+	// PolicyRewrite publishes invalid hostnames under their sanitised name
+	PolicyRewrite = "rewrite"
+	// PolicyReject drops leases with invalid hostnames
+	PolicyReject = "reject"
+)
+
+const (
+	maxLabelLength = 63
+	maxNameLength  = 253
+)
+
+type sanitizer struct {
+	policy string
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// seen remembers the result for every name, so that changes are logged
+	// once and not on every sync
+	seen map[string]result
+}
+
+type result struct {
+	name string
+	err  error
+}
+
+// NewSanitizer returns a sanitizer that turns hostnames into valid RFC 1123
+// names according to policy.
+func NewSanitizer(policy string, logger *zap.Logger) (*sanitizer, error) {
+	switch policy {
+	case PolicyRewrite, PolicyReject:
+	case "":
+		policy = PolicyRewrite
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPolicy, policy)
+	}
+	return &sanitizer{policy: policy, logger: logger, seen: make(map[string]result)}, nil
+}
+
+// Leases returns the leases with sanitised names. Leases whose name is
+// rejected are left out, the passed leases are not modified. Only the names
+// of the passed leases are remembered afterwards.
+func (s *sanitizer) Leases(leases []*parser.Lease) []*parser.Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]result, len(leases))
+	sanitized := make([]*parser.Lease, 0, len(leases))
+	for _, lease := range leases {
+		r, ok := seen[lease.Name]
+		if !ok {
+			r = s.lookup(lease.Name)
+			seen[lease.Name] = r
+		}
+		if r.err != nil {
+			continue
+		}
+		if r.name != lease.Name {
+			renamed := *lease
+			renamed.Name = r.name
+			lease = &renamed
+		}
+		sanitized = append(sanitized, lease)
+	}
+
+	// names of leases that are gone are forgotten, so that the map does not
+	// grow with every client ever seen
+	s.seen = seen
+	return sanitized
+}
+
+// lookup returns the remembered result for name or sanitises it. The caller
+// holds mu.
+func (s *sanitizer) lookup(name string) result {
+	if r, ok := s.seen[name]; ok {
+		return r
+	}
+	return s.sanitize(name)
+}
+
+func (s *sanitizer) sanitize(name string) result {
+	sanitized := Hostname(name)
+
+	// names differing only in case are equal in DNS and not worth a warning
+	if sanitized == strings.ToLower(strings.TrimSuffix(name, ".")) {
+		return result{name: sanitized}
+	}
+
+	if sanitized == "" {
+		s.logger.Warn("dropping hostname without valid characters", zap.String("name", name))
+		return result{err: fmt.Errorf("%w: %q", ErrInvalidHostname, name)}
+	}
+
+	if s.policy == PolicyReject {
+		s.logger.Warn("rejecting invalid hostname", zap.String("name", name), zap.String("valid", sanitized))
+		return result{err: fmt.Errorf("%w: %q", ErrInvalidHostname, name)}
+	}
+
+	s.logger.Info("rewriting invalid hostname", zap.String("name", name), zap.String("sanitized", sanitized))
+	return result{name: sanitized}
+}
+
+// Hostname returns name as lowercase RFC 1123 name. Internationalised labels
+// are converted to punycode, other characters that are not allowed are
+// replaced by hyphens or dropped. Labels are truncated to 63 octets and the
+// name to 253 octets. The result is empty if nothing valid remains.
+func Hostname(name string) string {
+	var labels []string
+	length := -1
+	for _, label := range strings.Split(name, ".") {
+		label = sanitizeLabel(label)
+		if label == "" {
+			continue
+		}
+		if length+1+len(label) > maxNameLength {
+			break
+		}
+		length += 1 + len(label)
+		labels = append(labels, label)
+	}
+	return strings.Join(labels, ".")
+}
+
+func sanitizeLabel(label string) string {
+	label = strings.ToLower(label)
+
+	var b strings.Builder
+	ascii := true
+	for _, r := range label {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r > unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)):
+			ascii = false
+			b.WriteRune(r)
+		case r > unicode.MaxASCII:
+			// symbols and other runes outside of IDNA are dropped
+		default:
+			// spaces, underscores and other punctuation separate words
+			b.WriteRune('-')
+		}
+	}
+	label = collapseHyphens(b.String())
+
+	if !ascii {
+		return encodeLabel([]rune(label))
+	}
+
+	if len(label) > maxLabelLength {
+		label = label[:maxLabelLength]
+	}
+	return strings.Trim(label, "-")
+}
+
+// encodeLabel returns the punycode of an internationalised label. Runes are
+// cut from the end of the label until its encoding fits into 63 octets, as
+// cutting the encoding itself would leave a label that does not decode.
+func encodeLabel(label []rune) string {
+	for ; len(label) > 0; label = label[:len(label)-1] {
+		trimmed := strings.Trim(string(label), "-")
+		encoded, err := idna.Lookup.ToASCII(trimmed)
+		if err != nil {
+			// fall back to the plain punycode encoding for labels that
+			// violate the IDNA rules, e.g. by mixing scripts
+			encoded, err = idna.Punycode.ToASCII(trimmed)
+		}
+		if err != nil {
+			return ""
+		}
+		if len(encoded) <= maxLabelLength {
+			return encoded
+		}
+	}
+	return ""
+}
+
+// collapseHyphens replaces runs of hyphens by a single one and removes
+// hyphens at the start and the end of label.
+func collapseHyphens(label string) string {
+	var b strings.Builder
+	for i, r := range label {
+		if r == '-' && i > 0 && label[i-1] == '-' {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrUnknownPolicy   = Error("unknown hostname policy")
+	ErrInvalidHostname = Error("invalid hostname")
+)
@@ -0,0 +1,98 @@
+package sanitize_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"github.com/heilerich/dhcpd-coredns/sanitize"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/idna"
+	"inet.af/netaddr"
+)
+
+func TestHostname(t *testing.T) {
+	cases := map[string]string{
+		"host1":                 "host1",
+		"Host1":                 "host1",
+		"my host":               "my-host",
+		"my_host__name":         "my-host-name",
+		"-leading-":             "leading",
+		"host.example.org.":     "host.example.org",
+		"host..example":         "host.example",
+		"bücher":                "xn--bcher-kva",
+		"Bücher-PC":             "xn--bcher-pc-65a",
+		"laptop 💻":              "laptop",
+		"💻":                     "",
+		"...":                   "",
+		strings.Repeat("a", 70): strings.Repeat("a", 63),
+	}
+
+	for name, expected := range cases {
+		assert.Equal(t, expected, sanitize.Hostname(name), "sanitized %q", name)
+	}
+
+	unicode := strings.Repeat("bücher", 20)
+	encoded := sanitize.Hostname(unicode)
+	assert.LessOrEqual(t, len(encoded), 63, "encoded label is truncated")
+	decoded, err := idna.Punycode.ToUnicode(encoded)
+	if assert.NoError(t, err, "truncated label decodes") {
+		assert.True(t, strings.HasPrefix(unicode, decoded), "%q is a prefix of the name", decoded)
+	}
+
+	long := strings.TrimSuffix(strings.Repeat(strings.Repeat("a", 63)+".", 5), ".")
+	sanitized := sanitize.Hostname(long)
+	assert.LessOrEqual(t, len(sanitized), 253, "name is truncated")
+	assert.Equal(t, strings.Repeat(strings.Repeat("a", 63)+".", 2)+strings.Repeat("a", 63), sanitized, "whole labels are kept")
+}
+
+func TestSanitizerPolicies(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	leases := []*parser.Lease{
+		{Name: "valid", Address: netaddr.MustParseIP("10.0.0.1")},
+		{Name: "Upper", Address: netaddr.MustParseIP("10.0.0.2")},
+		{Name: "in valid", Address: netaddr.MustParseIP("10.0.0.3")},
+		{Name: "__", Address: netaddr.MustParseIP("10.0.0.4")},
+	}
+
+	rewrite, err := sanitize.NewSanitizer(sanitize.PolicyRewrite, logger)
+	assert.NoError(t, err)
+	result := rewrite.Leases(leases)
+	if assert.Len(t, result, 3) {
+		assert.Equal(t, "valid", result[0].Name)
+		assert.Equal(t, "upper", result[1].Name)
+		assert.Equal(t, "in-valid", result[2].Name)
+		assert.Equal(t, "10.0.0.3", result[2].Address.String())
+	}
+	assert.Equal(t, "in valid", leases[2].Name, "original lease is not modified")
+
+	reject, err := sanitize.NewSanitizer(sanitize.PolicyReject, logger)
+	assert.NoError(t, err)
+	result = reject.Leases(leases)
+	if assert.Len(t, result, 2, "invalid hostnames are rejected") {
+		assert.Equal(t, "valid", result[0].Name)
+		assert.Equal(t, "upper", result[1].Name)
+	}
+
+	_, err = sanitize.NewSanitizer("ignore", logger)
+	assert.ErrorIs(t, err, sanitize.ErrUnknownPolicy)
+}
+
+func TestSanitizerForgetsGoneNames(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	sanitizer, err := sanitize.NewSanitizer(sanitize.PolicyRewrite, zap.New(core))
+	assert.NoError(t, err)
+
+	lease := &parser.Lease{Name: "in valid", Address: netaddr.MustParseIP("10.0.0.1")}
+	sanitizer.Leases([]*parser.Lease{lease})
+	sanitizer.Leases([]*parser.Lease{lease})
+	assert.Equal(t, 1, logs.FilterMessage("rewriting invalid hostname").Len(), "change is logged once")
+
+	sanitizer.Leases(nil)
+	sanitizer.Leases([]*parser.Lease{lease})
+	assert.Equal(t, 2, logs.FilterMessage("rewriting invalid hostname").Len(), "name of a gone lease is forgotten")
+}
@@ -3,9 +3,10 @@ package watcher
 import (
 	"context"
 	"sync"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/config"
 	"github.com/heilerich/dhcpd-coredns/parser"
 	"go.uber.org/zap"
 )
@@ -68,18 +69,110 @@ func (c *coordinator) Run(callback func()) {
 	}
 }
 
-func CoordinateWatcher(ctx context.Context, leaseFile string, backend backend.Backend, logger *zap.Logger, jobStart func(), jobStop func()) func(context.Context) {
+// Stage processes the leases found by a sync before they are published and
+// returns the leases to publish.
+type Stage func(leases []*parser.Lease) []*parser.Lease
+
+func CoordinateWatcher(ctx context.Context, leaseCfg *config.LeaseConfig, source LeaseSource, leaseBackend backend.Backend, logger *zap.Logger, jobStart func(), jobStop func(), stages ...Stage) func(context.Context) {
 	coordinator := NewCoordinator(ctx, logger)
-	leaseParser := parser.NewParser(logger)
+
+	accept := func(lease *parser.Lease, now time.Time) bool {
+		if !lease.InState(leaseCfg.States) {
+			logger.Debug("skipping lease", zap.String("name", lease.Name), zap.String("state", lease.BindingState))
+			return false
+		}
+		if lease.IsPrefix() {
+			// a delegated prefix has no host address to publish
+			logger.Debug("skipping prefix delegation", zap.String("name", lease.Name), zap.String("prefix", lease.Prefix.String()))
+			return false
+		}
+		if lease.Ended(now) {
+			logger.Debug("skipping ended lease", zap.String("name", lease.Name), zap.Time("ends", lease.Ends))
+			return false
+		}
+		return true
+	}
+
+	publish := func(ctx context.Context, lease *parser.Lease) {
+		logger.Debug("found lease", zap.String("name", lease.Name), zap.String("address", lease.Address.String()))
+		if err := leaseBackend.Put(ctx, lease); err != nil {
+			logger.Error("failed to send lease to backend", zap.String("name", lease.Name), zap.Error(err))
+		}
+	}
+
+	// read returns the leases of a sync and whether these are all current
+	// leases of the source
+	read := func(ctx context.Context) ([]*parser.Lease, bool) {
+		if complete, ok := source.(CompleteSource); ok && leaseCfg.Reconcile {
+			leases, err := complete.AllLeases(ctx)
+			if err != nil {
+				logger.Warn("failed to read all leases, not removing records", zap.Error(err))
+			}
+			return leases, err == nil
+		}
+
+		leases := []*parser.Lease{}
+		for lease := range source.Leases(ctx) {
+			leases = append(leases, lease)
+		}
+		return leases, false
+	}
+
+	reconcile := func(ctx context.Context, leases []*parser.Lease) {
+		current := make([]backend.Lease, len(leases))
+		for i, lease := range leases {
+			current[i] = lease
+		}
+
+		diff, err := leaseBackend.Reconcile(ctx, current)
+		if err != nil {
+			logger.Error("failed to reconcile backend", zap.Error(err))
+		}
+		if diff != nil && !diff.Empty() {
+			logger.Info("reconciled backend", zap.Int("added", len(diff.Added)),
+				zap.Int("updated", len(diff.Updated)), zap.Int("deleted", len(diff.Deleted)))
+		}
+	}
 
 	syncFn := func(ctx context.Context) {
 		logger.Debug("coordinator starting parse job")
-		leaseParser.ParseStreamingWithHandler(ctx, leaseFile, func(lease *parser.Lease) {
-			logger.Debug("found lease", zap.String("name", lease.Name), zap.String("address", lease.Address.String()))
-			if err := backend.Put(ctx, lease); err != nil {
-				logger.Error("failed to send lease to backend", zap.String("name", lease.Name), zap.Error(err))
+		now := time.Now()
+		found, complete := read(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		leases := []*parser.Lease{}
+		for _, lease := range found {
+			if accept(lease, now) {
+				leases = append(leases, lease)
 			}
-		})
+		}
+
+		for _, stage := range stages {
+			leases = stage(leases)
+		}
+
+		if complete {
+			reconcile(ctx, leases)
+			return
+		}
+
+		wg := sync.WaitGroup{}
+		for _, lease := range leases {
+			wg.Add(1)
+			go func(lease *parser.Lease) {
+				defer wg.Done()
+				publish(ctx, lease)
+			}(lease)
+		}
+		wg.Wait()
+
+		if flusher, ok := leaseBackend.(backend.Flusher); ok {
+			if err := flusher.Flush(ctx); err != nil {
+				logger.Error("failed to flush backend", zap.Error(err))
+			}
+		}
 	}
 
 	jobStart()
@@ -91,11 +184,10 @@ func CoordinateWatcher(ctx context.Context, leaseFile string, backend backend.Ba
 
 	jobStart()
 	go func() {
-		Watch(ctx, leaseFile, logger, func(event fsnotify.Event) {
-			logger.Debug("received fs event", zap.String("op", event.Op.String()))
+		source.Watch(ctx, func() {
 			coordinator.Signal()
 		})
-		logger.Debug("file watcher stopped")
+		logger.Debug("lease source watcher stopped")
 		jobStop()
 	}()
 
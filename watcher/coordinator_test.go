@@ -2,13 +2,22 @@ package watcher_test
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/heilerich/dhcpd-coredns/backend"
+	"github.com/heilerich/dhcpd-coredns/backend/memory"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"github.com/heilerich/dhcpd-coredns/sanitize"
+	"github.com/heilerich/dhcpd-coredns/util"
 	"github.com/heilerich/dhcpd-coredns/watcher"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap/zaptest"
+	"inet.af/netaddr"
 )
 
 func TestCoordinator(t *testing.T) {
@@ -101,3 +110,236 @@ func TestCoordinator(t *testing.T) {
 	<-stop
 	assert.Equal(t, 3, countCalls(), "after stop end")
 }
+
+type staticSource struct {
+	leases  []*parser.Lease
+	changed chan struct{}
+}
+
+func (s *staticSource) Leases(ctx context.Context) chan *parser.Lease {
+	ch := make(chan *parser.Lease)
+	go func() {
+		defer close(ch)
+		for _, lease := range s.leases {
+			ch <- lease
+		}
+	}()
+	return ch
+}
+
+func (s *staticSource) Watch(ctx context.Context, notify func()) {
+	for {
+		select {
+		case <-s.changed:
+			notify()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type recordingBackend struct {
+	puts       chan string
+	reconciled chan []string
+}
+
+func (b *recordingBackend) Put(ctx context.Context, lease backend.Lease) error {
+	b.puts <- lease.GetName()
+	return nil
+}
+
+func (b *recordingBackend) Reconcile(ctx context.Context, leases []backend.Lease) (*backend.Diff, error) {
+	names := []string{}
+	for _, lease := range leases {
+		names = append(names, lease.GetName())
+	}
+	b.reconciled <- names
+	return &backend.Diff{Added: leases}, nil
+}
+
+func (b *recordingBackend) Delete(ctx context.Context, lease backend.Lease) error { return nil }
+
+func (b *recordingBackend) List(ctx context.Context) ([]*backend.Record, error) { return nil, nil }
+
+func (b *recordingBackend) Get(ctx context.Context, name string) ([]*backend.Record, error) {
+	return nil, backend.ErrNotFound
+}
+
+func (b *recordingBackend) Cleanup(ctx context.Context) error { return nil }
+
+func (b *recordingBackend) Close(ctx context.Context) error { return nil }
+
+func TestCoordinateWatcherSource(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	source := &staticSource{
+		leases: []*parser.Lease{
+			{Name: "active", Address: netaddr.MustParseIP("10.0.0.1"), BindingState: "active"},
+			{Name: "free", Address: netaddr.MustParseIP("10.0.0.2"), BindingState: "free"},
+			{Name: "ended", Address: netaddr.MustParseIP("10.0.0.3"), BindingState: "active", Ends: time.Now().Add(-time.Minute)},
+		},
+		changed: make(chan struct{}),
+	}
+	testBackend := &recordingBackend{puts: make(chan string)}
+
+	leaseCfg := &config.LeaseConfig{States: []string{"active"}}
+	wg := &util.TimeoutGroup{}
+	watcher.CoordinateWatcher(ctx, leaseCfg, source, testBackend, logger, func() { wg.Add(1) }, wg.Done)
+
+	source.changed <- struct{}{}
+
+	select {
+	case name := <-testBackend.puts:
+		assert.Equal(t, "active", name)
+	case <-ctx.Done():
+		t.Fatal("context timed out")
+	}
+
+	select {
+	case name := <-testBackend.puts:
+		t.Errorf("unexpected put of %v", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	assert.NoError(t, wg.WaitWithTimeout(context.Background(), time.Second), "expect watcher to stop")
+}
+
+type completeSource struct {
+	staticSource
+	err error
+}
+
+func (s *completeSource) AllLeases(ctx context.Context) ([]*parser.Lease, error) {
+	return s.leases, s.err
+}
+
+func TestCoordinateWatcherReconcile(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	source := &completeSource{staticSource: staticSource{
+		leases: []*parser.Lease{
+			{Name: "active", Address: netaddr.MustParseIP("10.0.0.1"), BindingState: "active"},
+			{Name: "free", Address: netaddr.MustParseIP("10.0.0.2"), BindingState: "free"},
+		},
+		changed: make(chan struct{}),
+	}}
+	testBackend := &recordingBackend{puts: make(chan string), reconciled: make(chan []string)}
+
+	leaseCfg := &config.LeaseConfig{States: []string{"active"}, Reconcile: true}
+	wg := &util.TimeoutGroup{}
+	watcher.CoordinateWatcher(ctx, leaseCfg, source, testBackend, logger, func() { wg.Add(1) }, wg.Done)
+
+	source.changed <- struct{}{}
+
+	select {
+	case names := <-testBackend.reconciled:
+		assert.Equal(t, []string{"active"}, names, "complete lease set is reconciled")
+	case <-ctx.Done():
+		t.Fatal("context timed out")
+	}
+
+	// an incomplete lease set must not remove records
+	source.err = parser.ErrSyntax
+	source.changed <- struct{}{}
+
+	select {
+	case name := <-testBackend.puts:
+		assert.Equal(t, "active", name)
+	case names := <-testBackend.reconciled:
+		t.Errorf("unexpected reconcile of %v", names)
+	case <-ctx.Done():
+		t.Fatal("context timed out")
+	}
+
+	cancel()
+	assert.NoError(t, wg.WaitWithTimeout(context.Background(), time.Second), "expect watcher to stop")
+}
+
+func TestCoordinateWatcherPipeline(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	source := &completeSource{staticSource: staticSource{
+		leases: []*parser.Lease{
+			{Name: "Host One", Address: netaddr.MustParseIP("10.0.0.1"), BindingState: "active"},
+			{Name: "free", Address: netaddr.MustParseIP("10.0.0.2"), BindingState: "free"},
+		},
+		changed: make(chan struct{}),
+	}}
+	memoryBackend := memory.NewMemoryBackend(time.Minute, logger)
+	sanitizer, err := sanitize.NewSanitizer(sanitize.PolicyRewrite, logger)
+	assert.NoError(t, err)
+
+	leaseCfg := &config.LeaseConfig{States: []string{"active"}, Reconcile: true}
+	wg := &util.TimeoutGroup{}
+	syncFn := watcher.CoordinateWatcher(ctx, leaseCfg, source, memoryBackend, logger, func() { wg.Add(1) }, wg.Done,
+		sanitizer.Leases)
+
+	syncFn(ctx)
+	records, err := memoryBackend.List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "host-one (10.0.0.1)", records[0].String(), "sanitized lease is published")
+	}
+
+	source.leases = source.leases[1:]
+	syncFn(ctx)
+	records, err = memoryBackend.List(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, records, "record of the released lease is removed")
+
+	cancel()
+	assert.NoError(t, wg.WaitWithTimeout(context.Background(), time.Second), "expect watcher to stop")
+}
+
+func TestCoordinateWatcherReconcileCorruptFile(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	write := func(data string) {
+		// dhcpd writes a new file and renames it over the old one
+		assert.NoError(t, os.WriteFile(path+".tmp", []byte(data), 0644))
+		assert.NoError(t, os.Rename(path+".tmp", path))
+	}
+	declaration := func(address, name string) string {
+		return "lease " + address + " {\n  binding state active;\n  client-hostname \"" + name + "\";\n}\n"
+	}
+
+	write(declaration("10.0.0.1", "a") + declaration("10.0.0.2", "b") + declaration("10.0.0.3", "c"))
+
+	source := watcher.NewFileSource(path, parser.NewParser(logger), watcher.NewPollingWatcher(path, time.Hour, logger), logger)
+	testBackend := &recordingBackend{puts: make(chan string, 3), reconciled: make(chan []string, 1)}
+
+	leaseCfg := &config.LeaseConfig{States: []string{"active"}, Reconcile: true}
+	wg := &util.TimeoutGroup{}
+	syncFn := watcher.CoordinateWatcher(ctx, leaseCfg, source, testBackend, logger, func() { wg.Add(1) }, wg.Done)
+
+	syncFn(ctx)
+	assert.Equal(t, []string{"a", "b", "c"}, <-testBackend.reconciled)
+
+	// the corrupt declaration of b is skipped, the records must not be
+	// reconciled against the remaining leases
+	write(declaration("10.0.0.1", "a") + "lease 10.0.0.2 {\n  uid \"\\x\";\n}\n" + declaration("10.0.0.3", "c"))
+	syncFn(ctx)
+	assert.Empty(t, testBackend.reconciled, "incomplete lease set is not reconciled")
+	assert.ElementsMatch(t, []string{"a", "c"}, []string{<-testBackend.puts, <-testBackend.puts}, "remaining leases are published")
+
+	write(declaration("10.0.0.1", "a") + declaration("10.0.0.3", "c"))
+	syncFn(ctx)
+	assert.Equal(t, []string{"a", "c"}, <-testBackend.reconciled, "the rewritten file is reconciled")
+
+	cancel()
+	assert.NoError(t, wg.WaitWithTimeout(context.Background(), time.Second), "expect watcher to stop")
+}
@@ -0,0 +1,83 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+type pollingWatcher struct {
+	path     string
+	interval time.Duration
+	logger   *zap.Logger
+}
+
+var _ FileWatcher = &pollingWatcher{}
+
+// NewPollingWatcher returns a FileWatcher that compares inode, size and
+// modification time of the file at path every interval, for file systems
+// that do not support inotify, e.g. NFS.
+func NewPollingWatcher(path string, interval time.Duration, logger *zap.Logger) *pollingWatcher {
+	return &pollingWatcher{
+		path:     path,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+func (w *pollingWatcher) Watch(ctx context.Context, callback Callback) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	last := w.stat(nil)
+
+	w.logger.Info("polling file", zap.String("path", w.path), zap.Duration("interval", w.interval))
+	for {
+		select {
+		case <-ticker.C:
+			current := w.stat(last)
+			if op, changed := compareFileInfo(last, current); changed {
+				w.logger.Debug("file change detected", zap.String("path", w.path), zap.String("op", op.String()))
+				go callback(fsnotify.Event{Name: w.path, Op: op})
+			}
+			last = current
+		case <-ctx.Done():
+			w.logger.Info("file poller stopped", zap.String("path", w.path))
+			return
+		}
+	}
+}
+
+// stat returns nil if the file does not exist. Other errors, e.g. a stale
+// NFS file handle, return last so that they are not taken for a removal.
+func (w *pollingWatcher) stat(last os.FileInfo) os.FileInfo {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		w.logger.Error("failed to stat file", zap.String("path", w.path), zap.Error(err))
+		return last
+	}
+	return info
+}
+
+// compareFileInfo returns the operation that turns last into current.
+func compareFileInfo(last, current os.FileInfo) (fsnotify.Op, bool) {
+	switch {
+	case last == nil && current == nil:
+		return 0, false
+	case current == nil:
+		return fsnotify.Remove, true
+	case last == nil, !os.SameFile(last, current):
+		return fsnotify.Create, true
+	case last.Size() != current.Size(), !last.ModTime().Equal(current.ModTime()):
+		return fsnotify.Write, true
+	}
+	return 0, false
+}
@@ -0,0 +1,69 @@
+package watcher
+
+import (
+	"context"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/heilerich/dhcpd-coredns/parser"
+	"go.uber.org/zap"
+)
+
+// LeaseSource provides the leases that are published to the backend.
+type LeaseSource interface {
+	// Leases streams all current leases for a single sync and closes the
+	// channel afterwards.
+	Leases(ctx context.Context) chan *parser.Lease
+	// Watch blocks until ctx is done and calls notify whenever the leases
+	// might have changed.
+	Watch(ctx context.Context, notify func())
+}
+
+// CompleteSource is implemented by lease sources that report whether they
+// have read all current leases, which is required to reconcile the backend.
+type CompleteSource interface {
+	AllLeases(ctx context.Context) ([]*parser.Lease, error)
+}
+
+// LeaseParser reads the leases of a lease file.
+type LeaseParser interface {
+	ParseStreaming(ctx context.Context, path string) chan *parser.Lease
+	ParseAll(ctx context.Context, path string) ([]*parser.Lease, error)
+}
+
+type fileSource struct {
+	path    string
+	parser  LeaseParser
+	watcher FileWatcher
+	logger  *zap.Logger
+}
+
+var (
+	_ LeaseSource    = &fileSource{}
+	_ CompleteSource = &fileSource{}
+)
+
+// NewFileSource returns a LeaseSource that parses the lease file at path
+// and uses fileWatcher to watch it for changes.
+func NewFileSource(path string, leaseParser LeaseParser, fileWatcher FileWatcher, logger *zap.Logger) *fileSource {
+	return &fileSource{
+		path:    path,
+		parser:  leaseParser,
+		watcher: fileWatcher,
+		logger:  logger,
+	}
+}
+
+func (s *fileSource) Leases(ctx context.Context) chan *parser.Lease {
+	return s.parser.ParseStreaming(ctx, s.path)
+}
+
+func (s *fileSource) AllLeases(ctx context.Context) ([]*parser.Lease, error) {
+	return s.parser.ParseAll(ctx, s.path)
+}
+
+func (s *fileSource) Watch(ctx context.Context, notify func()) {
+	s.watcher.Watch(ctx, func(event fsnotify.Event) {
+		s.logger.Debug("received fs event", zap.String("op", event.Op.String()))
+		notify()
+	})
+}
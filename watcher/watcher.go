@@ -2,18 +2,70 @@ package watcher
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"path/filepath"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/heilerich/dhcpd-coredns/config"
 	"go.uber.org/zap"
 )
 
 type Callback func(event fsnotify.Event)
 
+// FileWatcher calls a callback whenever a file changes until the context is
+// done.
+type FileWatcher interface {
+	Watch(ctx context.Context, callback Callback)
+}
+
+const (
+	WatcherNotify = "notify"
+	WatcherPoll   = "poll"
+)
+
+// NewFileWatcher returns the FileWatcher selected by the lease config.
+func NewFileWatcher(leaseCfg *config.LeaseConfig, logger *zap.Logger) (FileWatcher, error) {
+	switch leaseCfg.Watcher {
+	case WatcherNotify, "":
+		return NewNotifyWatcher(leaseCfg.File, logger), nil
+	case WatcherPoll:
+		if leaseCfg.PollInterval <= 0 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPollInterval, leaseCfg.PollInterval)
+		}
+		return NewPollingWatcher(leaseCfg.File, leaseCfg.PollInterval, logger), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownWatcher, leaseCfg.Watcher)
+}
+
+type notifyWatcher struct {
+	path   string
+	logger *zap.Logger
+}
+
+var _ FileWatcher = &notifyWatcher{}
+
+// NewNotifyWatcher returns a FileWatcher that uses inotify or the
+// equivalent of the platform.
+func NewNotifyWatcher(path string, logger *zap.Logger) *notifyWatcher {
+	return &notifyWatcher{path: path, logger: logger}
+}
+
+func (w *notifyWatcher) Watch(ctx context.Context, callback Callback) {
+	Watch(ctx, w.path, w.logger, callback)
+}
+
+// Watch calls callback for every change of the file at path. It watches the
+// parent directory instead of the file itself, so that it keeps working when
+// the file is replaced, e.g. when dhcpd renames a new lease file over the
+// old one.
 func Watch(ctx context.Context, path string, logger *zap.Logger, callback Callback) {
 	watchCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
@@ -28,6 +80,9 @@ func Watch(ctx context.Context, path string, logger *zap.Logger, callback Callba
 				if !ok {
 					return
 				}
+				if filepath.Clean(event.Name) != path || event.Op == fsnotify.Chmod {
+					continue
+				}
 				logger.Debug("file system event", zap.String("path", event.Name), zap.String("op", event.Op.String()))
 				go callback(event)
 			case err, ok := <-watcher.Errors:
@@ -39,9 +94,9 @@ func Watch(ctx context.Context, path string, logger *zap.Logger, callback Callba
 		}
 	}()
 
-	err = watcher.Add(path)
+	err = watcher.Add(dir)
 	if err != nil {
-		logger.Fatal("failed to watch file", zap.String("path", path), zap.Error(err))
+		logger.Fatal("failed to watch directory", zap.String("path", dir), zap.Error(err))
 		cancel()
 	}
 
@@ -49,3 +104,12 @@ func Watch(ctx context.Context, path string, logger *zap.Logger, callback Callba
 	<-watchCtx.Done()
 	logger.Info("file watcher stopped", zap.String("path", path))
 }
+
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+const (
+	ErrUnknownWatcher      = Error("unknown file watcher")
+	ErrInvalidPollInterval = Error("poll interval must be positive")
+)
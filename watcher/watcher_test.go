@@ -0,0 +1,175 @@
+package watcher_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/heilerich/dhcpd-coredns/config"
+	"github.com/heilerich/dhcpd-coredns/watcher"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func expectEvent(t *testing.T, ctx context.Context, events chan fsnotify.Event, op fsnotify.Op, msg string) {
+	for {
+		select {
+		case event := <-events:
+			if event.Op&op != 0 {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatalf("context timed out waiting for %v: %v", op, msg)
+		}
+	}
+}
+
+func drainEvents(events chan fsnotify.Event) {
+	for {
+		select {
+		case <-events:
+		case <-time.After(20 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestWatchRotation(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	testRotation(t, func(path string) watcher.FileWatcher {
+		return watcher.NewNotifyWatcher(path, logger)
+	})
+}
+
+func TestPollingRotation(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	testRotation(t, func(path string) watcher.FileWatcher {
+		fileWatcher, err := watcher.NewFileWatcher(&config.LeaseConfig{
+			File:         path,
+			Watcher:      watcher.WatcherPoll,
+			PollInterval: 5 * time.Millisecond,
+		}, logger)
+		assert.NoError(t, err)
+		return fileWatcher
+	})
+}
+
+func TestFileWatcherConfig(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	_, err := watcher.NewFileWatcher(&config.LeaseConfig{Watcher: "unknown"}, logger)
+	assert.ErrorIs(t, err, watcher.ErrUnknownWatcher)
+
+	_, err = watcher.NewFileWatcher(&config.LeaseConfig{Watcher: watcher.WatcherPoll}, logger)
+	assert.ErrorIs(t, err, watcher.ErrInvalidPollInterval)
+}
+
+func testRotation(t *testing.T, newWatcher func(path string) watcher.FileWatcher) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dhcpd.leases")
+	assert.NoError(t, os.WriteFile(path, []byte("# initial\n"), 0644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	events := make(chan fsnotify.Event, 100)
+	stopped := make(chan struct{})
+	fileWatcher := newWatcher(path)
+	go func() {
+		fileWatcher.Watch(ctx, func(event fsnotify.Event) {
+			events <- event
+		})
+		close(stopped)
+	}()
+
+	// give fs watcher time to start
+	time.Sleep(10 * time.Millisecond)
+
+	appendData := func(data string) {
+		leaseFile, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		_, err = leaseFile.WriteString(data)
+		assert.NoError(t, err)
+		assert.NoError(t, leaseFile.Close())
+	}
+
+	appendData("# append\n")
+	expectEvent(t, ctx, events, fsnotify.Write, "append before rotation")
+
+	// dhcpd writes a new file, links the old one to a backup and renames
+	// the new file over the old one
+	newFile := filepath.Join(dir, "dhcpd.leases.1663748274")
+	assert.NoError(t, os.WriteFile(newFile, []byte("# rotated\n"), 0644))
+	assert.NoError(t, os.Link(path, filepath.Join(dir, "dhcpd.leases~")))
+	assert.NoError(t, os.Rename(newFile, path))
+	expectEvent(t, ctx, events, fsnotify.Create, "rename over lease file")
+
+	drainEvents(events)
+	appendData("# append\n")
+	expectEvent(t, ctx, events, fsnotify.Write, "append after rotation")
+
+	assert.NoError(t, os.Remove(path))
+	expectEvent(t, ctx, events, fsnotify.Remove, "remove lease file")
+
+	assert.NoError(t, os.WriteFile(path, []byte("# recreated\n"), 0644))
+	expectEvent(t, ctx, events, fsnotify.Create, "recreate lease file")
+
+	drainEvents(events)
+	appendData("# append\n")
+	expectEvent(t, ctx, events, fsnotify.Write, "append after recreation")
+
+	drainEvents(events)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "unrelated"), []byte("data"), 0644))
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event for other file: %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	<-stopped
+}
+
+func TestPollingIgnoresStatErrors(t *testing.T) {
+	dir := t.TempDir()
+	leaseDir := filepath.Join(dir, "dhcp")
+	link := filepath.Join(dir, "link")
+	path := filepath.Join(link, "dhcpd.leases")
+	assert.NoError(t, os.Mkdir(leaseDir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(leaseDir, "dhcpd.leases"), []byte("# initial\n"), 0644))
+	assert.NoError(t, os.Symlink(leaseDir, link))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	events := make(chan fsnotify.Event, 100)
+	stopped := make(chan struct{})
+	fileWatcher := watcher.NewPollingWatcher(path, 5*time.Millisecond, zaptest.NewLogger(t))
+	go func() {
+		fileWatcher.Watch(ctx, func(event fsnotify.Event) {
+			events <- event
+		})
+		close(stopped)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// the directory turns into a file, which fails the stat with ENOTDIR
+	// instead of telling that the lease file is gone
+	other := filepath.Join(dir, "other")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "file"), other))
+	assert.NoError(t, os.Rename(other, link))
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event for failed stat: %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	<-stopped
+}